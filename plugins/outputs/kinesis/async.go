@@ -0,0 +1,120 @@
+package kinesis
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// defaultAsyncQueueSize is the number of writes queued when async_queue_size
+// is not set.
+const defaultAsyncQueueSize = 10
+
+// startAsync creates the queue of pending writes and the goroutine sending
+// them, unless they are already running.
+func (k *KinesisOutput) startAsync() {
+	k.queueLock.Lock()
+	defer k.queueLock.Unlock()
+	if k.queue != nil {
+		return
+	}
+
+	size := k.AsyncQueueSize
+	if size <= 0 {
+		size = defaultAsyncQueueSize
+	}
+	queue := make(chan []*kinesis.PutRecordsRequestEntry, size)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	k.queue, k.asyncDone, k.asyncStop = queue, done, stop
+
+	go func() {
+		defer close(done)
+		for r := range queue {
+			// once Close has given up waiting, the fallback file and the
+			// client may be closed, so the remaining writes are dropped
+			select {
+			case <-stop:
+				k.asyncDropped.Incr(int64(len(r)))
+				continue
+			default:
+			}
+			k.writeRecords(r)
+		}
+	}()
+}
+
+// enqueue queues the records of a write. When the queue is full the records
+// are dropped, or with async_full_behavior set to "block" the write waits
+// for room in the queue. Records are also dropped once the output is
+// closing.
+func (k *KinesisOutput) enqueue(r []*kinesis.PutRecordsRequestEntry) {
+	if len(r) == 0 {
+		return
+	}
+
+	k.queueLock.RLock()
+	defer k.queueLock.RUnlock()
+	if k.queue == nil {
+		k.dropClosing(r)
+		return
+	}
+
+	if k.AsyncFullBehavior == "block" {
+		select {
+		case k.queue <- r:
+		case <-k.ctx.Done():
+			k.dropClosing(r)
+		}
+		return
+	}
+
+	select {
+	case k.queue <- r:
+	default:
+		k.asyncDropped.Incr(int64(len(r)))
+		k.Log.Warnf("Async queue is full, dropping %d record(s)", len(r))
+	}
+}
+
+// dropClosing counts and logs records that can no longer be queued.
+func (k *KinesisOutput) dropClosing(r []*kinesis.PutRecordsRequestEntry) {
+	k.asyncDropped.Incr(int64(len(r)))
+	k.Log.Warnf("Output is closing, dropping %d record(s)", len(r))
+}
+
+// stopAsync closes the queue and waits up to async_close_timeout for the
+// queued writes to be sent. On timeout the writes still queued are dropped,
+// and the sender stops once the write in flight returns. Writes blocked on a
+// full queue must have been released by cancelling the context first.
+func (k *KinesisOutput) stopAsync() {
+	k.queueLock.Lock()
+	if k.queue == nil {
+		k.queueLock.Unlock()
+		return
+	}
+
+	queue := k.queue
+	pending := len(queue)
+	close(queue)
+	k.queue = nil
+	k.queueLock.Unlock()
+
+	timeout := k.AsyncCloseTimeout.Duration
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	select {
+	case <-k.asyncDone:
+	case <-time.After(timeout):
+		close(k.asyncStop)
+		dropped := 0
+		for r := range queue {
+			dropped += len(r)
+		}
+		k.asyncDropped.Incr(int64(dropped))
+		k.Log.Warnf("Timed out after %s sending %d queued write(s), dropping %d unsent record(s)",
+			timeout, pending, dropped)
+	}
+}
@@ -0,0 +1,210 @@
+package kinesis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newAsyncOutput(t *testing.T, svc *mockKinesisPutRecords) *KinesisOutput {
+	k := &KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "partitionKey",
+		},
+		StreamName: "stream",
+		Async:      true,
+		serializer: influx.NewSerializer(),
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+	return k
+}
+
+func TestAsync_DrainOnClose(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+	svc.SetupGenericResponse(1, 0)
+
+	k := newAsyncOutput(t, svc)
+	k.startAsync()
+
+	metrics := []telegraf.Metric{
+		testutil.TestMetric(1, "metric1"),
+		testutil.TestMetric(2, "metric2"),
+	}
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics[:1]))
+
+	// the queued writes are sent before Close returns
+	require.NoError(t, k.Close())
+	require.Len(t, svc.requests, 2)
+	require.Len(t, svc.requests[0].Records, 2)
+	require.Len(t, svc.requests[1].Records, 1)
+}
+
+func TestAsync_FullQueueDrops(t *testing.T) {
+	k := newAsyncOutput(t, &mockKinesisPutRecords{})
+	// without a goroutine sending the queue fills after one write
+	k.queue = make(chan []*kinesis.PutRecordsRequestEntry, 1)
+
+	metrics := []telegraf.Metric{
+		testutil.TestMetric(1, "metric1"),
+		testutil.TestMetric(2, "metric2"),
+	}
+	before := k.asyncDropped.Get()
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics))
+	require.Equal(t, before+2, k.asyncDropped.Get())
+	require.Len(t, k.queue, 1)
+}
+
+func TestAsync_FullQueueBlocks(t *testing.T) {
+	k := newAsyncOutput(t, &mockKinesisPutRecords{})
+	k.AsyncFullBehavior = "block"
+	k.queue = make(chan []*kinesis.PutRecordsRequestEntry, 1)
+
+	metrics := []telegraf.Metric{testutil.TestMetric(1, "metric1")}
+	require.NoError(t, k.Write(metrics))
+
+	done := make(chan error)
+	go func() {
+		done <- k.Write(metrics)
+	}()
+
+	select {
+	case <-done:
+		require.FailNow(t, "write returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-k.queue
+	require.NoError(t, <-done)
+	require.Len(t, k.queue, 1)
+}
+
+func TestAsync_BlockedWriteDroppedOnClose(t *testing.T) {
+	log := &recordingLogger{}
+	k := newAsyncOutput(t, &mockKinesisPutRecords{})
+	k.Log = log
+	k.AsyncFullBehavior = "block"
+	k.queue = make(chan []*kinesis.PutRecordsRequestEntry, 1)
+	k.asyncDone = make(chan struct{})
+	close(k.asyncDone)
+
+	metrics := []telegraf.Metric{testutil.TestMetric(1, "metric1")}
+	require.NoError(t, k.Write(metrics))
+
+	done := make(chan error)
+	go func() {
+		done <- k.Write(metrics)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	before := k.asyncDropped.Get()
+	require.NoError(t, k.Close())
+	require.NoError(t, <-done)
+	require.Equal(t, before+1, k.asyncDropped.Get())
+	require.Contains(t, log.Messages("W!"), "Output is closing, dropping 1 record(s)")
+
+	// writes after Close are dropped as well
+	require.NoError(t, k.Write(metrics))
+	require.Equal(t, before+2, k.asyncDropped.Get())
+}
+
+func TestAsync_CloseTimeout(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupHangingResponse()
+
+	log := &recordingLogger{}
+	k := newAsyncOutput(t, svc)
+	k.Log = log
+	k.PutRecordsTimeout = internal.Duration{Duration: time.Second}
+	k.AsyncCloseTimeout = internal.Duration{Duration: 10 * time.Millisecond}
+	k.startAsync()
+
+	require.NoError(t, k.Write([]telegraf.Metric{testutil.TestMetric(1, "metric1")}))
+	require.NoError(t, k.Close())
+
+	timedOut := false
+	for _, message := range log.Messages("W!") {
+		if strings.HasPrefix(message, "Timed out after 10ms sending") {
+			timedOut = true
+		}
+	}
+	require.True(t, timedOut)
+}
+
+func TestAsync_CloseTimeoutDropsQueued(t *testing.T) {
+	k := newAsyncOutput(t, &mockKinesisPutRecords{})
+	k.AsyncCloseTimeout = internal.Duration{Duration: 10 * time.Millisecond}
+	// without a goroutine sending, the queued writes are never sent
+	k.queue = make(chan []*kinesis.PutRecordsRequestEntry, 2)
+	k.asyncDone = make(chan struct{})
+	k.asyncStop = make(chan struct{})
+
+	metrics := []telegraf.Metric{
+		testutil.TestMetric(1, "metric1"),
+		testutil.TestMetric(2, "metric2"),
+	}
+	before := k.asyncDropped.Get()
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics[:1]))
+
+	require.NoError(t, k.Close())
+	require.Equal(t, before+3, k.asyncDropped.Get())
+
+	// the sender stops sending once Close has timed out
+	select {
+	case <-k.asyncStop:
+	default:
+		t.Fatal("sender was not stopped")
+	}
+}
+
+func TestInit_InvalidAsync(t *testing.T) {
+	tests := []struct {
+		name   string
+		output *KinesisOutput
+	}{
+		{
+			name:   "full behavior",
+			output: &KinesisOutput{Async: true, AsyncFullBehavior: "wait"},
+		},
+		{
+			name:   "buffering",
+			output: &KinesisOutput{Async: true, MinFlushBytes: internal.Size{Size: 1024}},
+		},
+		{
+			name:   "retry on throttle",
+			output: &KinesisOutput{Async: true, RetryOnThrottle: true},
+		},
+		{
+			name:   "circuit breaker",
+			output: &KinesisOutput{Async: true, CircuitBreakerThreshold: 3},
+		},
+		{
+			name:   "return errors on drop",
+			output: &KinesisOutput{Async: true, ReturnErrorsOnDrop: true},
+		},
+		{
+			name:   "strict",
+			output: &KinesisOutput{Async: true, Strict: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.output.Log = testutil.Logger{}
+			require.Error(t, tt.output.Init())
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package kinesis
+
+import (
+	"errors"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open, skipping write to Kinesis")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops writes after a number of consecutive failed writes.
+// Once the cooldown has elapsed a single write is allowed through to probe
+// whether Kinesis has recovered.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a write may be attempted.
+func (c *circuitBreaker) allow(now time.Time) error {
+	if c.state == circuitOpen {
+		if now.Sub(c.openedAt) < c.cooldown {
+			return errCircuitOpen
+		}
+		c.state = circuitHalfOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a write and returns the
+// resulting state.
+func (c *circuitBreaker) record(success bool, now time.Time) circuitState {
+	if success {
+		c.state = circuitClosed
+		c.failures = 0
+		return c.state
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= c.threshold {
+		c.state = circuitOpen
+		c.openedAt = now
+	}
+	return c.state
+}
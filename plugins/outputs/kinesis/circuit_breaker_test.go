@@ -0,0 +1,49 @@
+package kinesis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := &circuitBreaker{
+		threshold: 2,
+		cooldown:  time.Minute,
+	}
+
+	require.NoError(t, c.allow(now))
+	require.Equal(t, circuitClosed, c.record(false, now))
+	require.NoError(t, c.allow(now))
+	require.Equal(t, circuitOpen, c.record(false, now))
+
+	require.Equal(t, errCircuitOpen, c.allow(now.Add(30*time.Second)))
+
+	// a failed probe re-opens the breaker for another cooldown
+	now = now.Add(time.Minute)
+	require.NoError(t, c.allow(now))
+	require.Equal(t, circuitHalfOpen, c.state)
+	require.Equal(t, circuitOpen, c.record(false, now))
+	require.Equal(t, errCircuitOpen, c.allow(now.Add(time.Second)))
+
+	// a successful probe closes the breaker
+	now = now.Add(time.Minute)
+	require.NoError(t, c.allow(now))
+	require.Equal(t, circuitClosed, c.record(true, now))
+	require.Equal(t, 0, c.failures)
+}
+
+func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := &circuitBreaker{
+		threshold: 2,
+		cooldown:  time.Minute,
+	}
+
+	require.Equal(t, circuitClosed, c.record(false, now))
+	require.Equal(t, circuitClosed, c.record(true, now))
+	require.Equal(t, circuitClosed, c.record(false, now))
+	require.NoError(t, c.allow(now))
+}
@@ -0,0 +1,274 @@
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Limit set by AWS (https://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecordsRequestEntry.html),
+// covering the record data and partition key together.
+const maxRecordSize = 1024 * 1024
+
+// maxGzipSize returns an upper bound for the size of n bytes once gzipped.
+// Incompressible input is written in stored deflate blocks, which add 5 bytes
+// per block, and gzip adds an 18 byte header and footer. Blocks are assumed
+// to hold at least 8KiB, which is less than the compressor uses.
+func maxGzipSize(n int) int {
+	return n + 5*(n/(8*1024)+2) + 18
+}
+
+// maxZstdSize returns an upper bound for the size of n bytes once compressed
+// with zstd, the ZSTD_COMPRESSBOUND of the reference implementation, which
+// covers the frame header, dictionary id and checksum.
+func maxZstdSize(n int) int {
+	bound := n + n>>8
+	if n < 128*1024 {
+		bound += (128*1024 - n) >> 11
+	}
+	return bound
+}
+
+// compressRecords packs the records sharing a partition key into compressed
+// records within the record limit of the backend and metricsPerRecord,
+// keeping the order of the records for each key. It returns the compressed records, the
+// number of records packed into each and the number of records dropped
+// because they do not fit in a record on their own, even once compressed.
+func (k *KinesisOutput) compressRecords(r []*kinesis.PutRecordsRequestEntry) ([]*kinesis.PutRecordsRequestEntry, []int, int) {
+	keys := []string{}
+	groups := map[string][]*kinesis.PutRecordsRequestEntry{}
+	for _, record := range r {
+		key := aws.StringValue(record.PartitionKey)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	compressed := []*kinesis.PutRecordsRequestEntry{}
+	counts := []int{}
+	dropped := 0
+	perRecord := k.metricsPerRecord()
+	for _, key := range keys {
+		limit := k.recordDataLimit(key)
+
+		var pending [][]byte
+		size := 0
+		flush := func() {
+			if len(pending) == 0 {
+				return
+			}
+			record, err := k.compressRecord(key, pending)
+			if err == nil && len(record.Data) > limit {
+				err = fmt.Errorf("compressed record of %d bytes is larger than the record limit", len(record.Data))
+			}
+			if err != nil {
+				k.Log.Errorf("Unable to compress %d metric(s) for partition key %q: %v", len(pending), key, err)
+				dropped += len(pending)
+			} else {
+				compressed = append(compressed, record)
+				counts = append(counts, len(pending))
+			}
+			pending = nil
+			size = 0
+		}
+
+		for _, record := range groups[key] {
+			if k.maxCompressedSize(len(record.Data)) > limit {
+				// the bound assumes incompressible data, so compress the
+				// metric on its own before deciding to drop it
+				flush()
+				solo, err := k.compressRecord(key, [][]byte{record.Data})
+				if err == nil && len(solo.Data) <= limit {
+					compressed = append(compressed, solo)
+					counts = append(counts, 1)
+					continue
+				}
+				k.Log.Warnf("Dropping metric of %d bytes with partition key %q, larger than the %d byte record limit",
+					len(record.Data), key, limit)
+				dropped++
+				continue
+			}
+
+			if k.maxCompressedSize(size+len(record.Data)) > limit {
+				flush()
+			}
+			if perRecord > 0 && len(pending) >= perRecord {
+				flush()
+			}
+			pending = append(pending, record.Data)
+			size += len(record.Data)
+		}
+		flush()
+	}
+	return compressed, counts, dropped
+}
+
+// metricsPerRecord returns the maximum number of metrics packed into a
+// compressed record, which is one with records_per_metric, or 0 when
+// unlimited.
+func (k *KinesisOutput) metricsPerRecord() int {
+	if k.RecordsPerMetric {
+		return 1
+	}
+	return k.MaxMetricsPerRecord
+}
+
+// timeBuckets groups the metrics by the time_bucket window of their
+// timestamp, after timestamp_precision is applied, so that compressed records
+// only hold metrics from a single window. Buckets are in the order of their
+// first metric and keep the order of the metrics in each.
+func (k *KinesisOutput) timeBuckets(metrics []telegraf.Metric) [][]telegraf.Metric {
+	window := k.TimeBucket.Duration
+	if window <= 0 || k.ContentEncoding == "identity" {
+		return [][]telegraf.Metric{metrics}
+	}
+
+	starts := []int64{}
+	buckets := map[int64][]telegraf.Metric{}
+	for _, metric := range metrics {
+		t := metric.Time()
+		if k.TimestampPrecision.Duration > 0 {
+			t = t.Round(k.TimestampPrecision.Duration)
+		}
+		start := t.Truncate(window).UnixNano()
+		if _, ok := buckets[start]; !ok {
+			starts = append(starts, start)
+		}
+		buckets[start] = append(buckets[start], metric)
+	}
+
+	grouped := make([][]telegraf.Metric, 0, len(starts))
+	for _, start := range starts {
+		grouped = append(grouped, buckets[start])
+	}
+	return grouped
+}
+
+// maxCompressedSize returns an upper bound for the size of n bytes once
+// compressed with the content encoding.
+func (k *KinesisOutput) maxCompressedSize(n int) int {
+	if k.ContentEncoding == "zstd" {
+		return maxZstdSize(n)
+	}
+	return maxGzipSize(n) + k.gzipHeaderSize()
+}
+
+// gzipHeaderSize returns an upper bound for the size of the optional gzip
+// header fields. Each is written as Latin-1 followed by a zero byte, which is
+// never longer than the UTF-8 string.
+func (k *KinesisOutput) gzipHeaderSize() int {
+	size := 0
+	if k.GzipHeaderName != "" {
+		size += len(k.GzipHeaderName) + 1
+	}
+	if k.GzipHeaderComment != "" {
+		size += len(k.GzipHeaderComment) + 1
+	}
+	return size
+}
+
+// validGzipHeaderField reports whether the string can be stored in a gzip
+// header field, which holds Latin-1 text terminated by a zero byte.
+func validGzipHeaderField(s string) bool {
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *KinesisOutput) compressRecord(key string, data [][]byte) (*kinesis.PutRecordsRequestEntry, error) {
+	if k.ContentEncoding != "zstd" {
+		return k.gzipRecord(key, data)
+	}
+
+	src := data[0]
+	if len(data) > 1 {
+		src = bytes.Join(data, nil)
+	}
+	return &kinesis.PutRecordsRequestEntry{
+		Data:         k.zstdEncoder.EncodeAll(src, nil),
+		PartitionKey: aws.String(key),
+	}, nil
+}
+
+// newZstdCodec creates the zstd encoder, and the decoder used for the
+// fallback file, with the dictionary from zstd_dictionary_file when set. They
+// are only used with EncodeAll and DecodeAll, so a single one of each is
+// shared by all writes.
+func (k *KinesisOutput) newZstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	encoderOpts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	decoderOpts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if k.ZstdDictionaryFile != "" {
+		dict, err := ioutil.ReadFile(k.ZstdDictionaryFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		encoderOpts = append(encoderOpts, zstd.WithEncoderDict(dict))
+		decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(dict))
+	}
+
+	encoder, err := zstd.NewWriter(nil, encoderOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoder, err := zstd.NewReader(nil, decoderOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoder, decoder, nil
+}
+
+// decodeRecord reverses the record and content encodings of the record data,
+// returning the serialized metrics it holds.
+func (k *KinesisOutput) decodeRecord(data []byte) ([]byte, error) {
+	if k.RecordEncoding == "base64" {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, data)
+		if err != nil {
+			return nil, err
+		}
+		data = decoded[:n]
+	}
+
+	switch k.ContentEncoding {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case "zstd":
+		return k.zstdDecoder.DecodeAll(data, nil)
+	}
+	return data, nil
+}
+
+func (k *KinesisOutput) gzipRecord(key string, data [][]byte) (*kinesis.PutRecordsRequestEntry, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Name = k.GzipHeaderName
+	w.Comment = k.GzipHeaderComment
+	for _, d := range data {
+		if _, err := w.Write(d); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return &kinesis.PutRecordsRequestEntry{
+		Data:         buf.Bytes(),
+		PartitionKey: aws.String(key),
+	}, nil
+}
@@ -0,0 +1,745 @@
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func gunzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return decompressed
+}
+
+// randomGzipData returns random data that is exactly size bytes once
+// gzipped without header fields.
+func randomGzipData(t *testing.T, size int) []byte {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	k := KinesisOutput{}
+	n := size
+	for {
+		record, err := k.gzipRecord("", [][]byte{data[:n]})
+		require.NoError(t, err)
+		if len(record.Data) == size {
+			return data[:n]
+		}
+		n -= len(record.Data) - size
+	}
+}
+
+func TestWrite_GzipPartitionMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		partition *Partition
+		keys      []string
+		records   uint32
+	}{
+		{
+			name:      "static",
+			partition: &Partition{Method: "static", Key: "static"},
+			keys:      []string{"static", "static", "static", "static"},
+			records:   1,
+		},
+		{
+			name:      "tag",
+			partition: &Partition{Method: "tag", Key: "host"},
+			keys:      []string{"a", "b", "a", "b"},
+			records:   2,
+		},
+		{
+			name:      "measurement",
+			partition: &Partition{Method: "measurement"},
+			keys:      []string{"cpu", "cpu", "mem", "mem"},
+			records:   2,
+		},
+		{
+			name:      "measurement_tag",
+			partition: &Partition{Method: "measurement_tag", Key: "host"},
+			keys:      []string{"cpu/a", "cpu/b", "mem/a", "mem/b"},
+			records:   4,
+		},
+		{
+			name:      "random",
+			partition: &Partition{Method: "random"},
+			records:   4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+
+			metrics := []telegraf.Metric{
+				testutil.MustMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": 1}, time.Unix(1, 0)),
+				testutil.MustMetric("cpu", map[string]string{"host": "b"}, map[string]interface{}{"value": 2}, time.Unix(2, 0)),
+				testutil.MustMetric("mem", map[string]string{"host": "a"}, map[string]interface{}{"value": 3}, time.Unix(3, 0)),
+				testutil.MustMetric("mem", map[string]string{"host": "b"}, map[string]interface{}{"value": 4}, time.Unix(4, 0)),
+			}
+
+			// the uncompressed data expected for each key, in order
+			expected := map[string][]byte{}
+			for i, m := range metrics {
+				if tt.keys == nil {
+					continue
+				}
+				data, err := serializer.Serialize(m)
+				require.NoError(t, err)
+				expected[tt.keys[i]] = append(expected[tt.keys[i]], data...)
+			}
+
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(tt.records, 0)
+
+			k := KinesisOutput{
+				Log:             testutil.Logger{},
+				Partition:       tt.partition,
+				StreamName:      "stream",
+				ContentEncoding: "gzip",
+				serializer:      serializer,
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+			require.NoError(t, k.Write(metrics))
+			require.Len(t, svc.requests, 1)
+			require.Len(t, svc.requests[0].Records, int(tt.records))
+
+			actual := map[string][]byte{}
+			for _, record := range svc.requests[0].Records {
+				key := aws.StringValue(record.PartitionKey)
+				require.NotContains(t, actual, key, "metrics for a key should be packed in one record")
+				actual[key] = gunzip(t, record.Data)
+			}
+
+			if tt.keys != nil {
+				require.Equal(t, expected, actual)
+			}
+		})
+	}
+}
+
+func TestCompressRecords_RecordLimit(t *testing.T) {
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+	}
+
+	// random data does not compress, so it has to be split across records
+	rnd := rand.New(rand.NewSource(1))
+	r := []*kinesis.PutRecordsRequestEntry{}
+	expected := []byte{}
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 200*1024)
+		rnd.Read(data)
+		expected = append(expected, data...)
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String("partitionKey"),
+			Data:         data,
+		})
+	}
+
+	// a single incompressible metric larger than a record is dropped
+	oversized := make([]byte, maxRecordSize)
+	rnd.Read(oversized)
+	r = append(r, &kinesis.PutRecordsRequestEntry{
+		PartitionKey: aws.String("partitionKey"),
+		Data:         oversized,
+	})
+
+	compressed, _, dropped := k.compressRecords(r)
+	require.Equal(t, 1, dropped)
+	require.Len(t, compressed, 2)
+
+	actual := []byte{}
+	for _, record := range compressed {
+		require.LessOrEqual(t, len(record.Data)+len(aws.StringValue(record.PartitionKey)), maxRecordSize)
+		actual = append(actual, gunzip(t, record.Data)...)
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestCompressRecords_PartitionKeyCountsTowardsLimit(t *testing.T) {
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+	}
+
+	// random data that fits in a record with a short partition key, but not
+	// with one of the maximum length
+	shortKey := "k"
+	data := randomGzipData(t, maxRecordSize-len(shortKey))
+
+	compressed, _, dropped := k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String(shortKey), Data: data},
+	})
+	require.Zero(t, dropped)
+	require.Len(t, compressed, 1)
+	require.LessOrEqual(t, len(compressed[0].Data)+len(shortKey), maxRecordSize)
+
+	longKey := string(bytes.Repeat([]byte("k"), maxPartitionKeyLength))
+	compressed, _, dropped = k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String(longKey), Data: data},
+	})
+	require.Equal(t, 1, dropped)
+	require.Empty(t, compressed)
+}
+
+func TestCompressRecords_MaxMetricsPerRecord(t *testing.T) {
+	k := KinesisOutput{
+		Log:                 testutil.Logger{},
+		ContentEncoding:     "gzip",
+		MaxMetricsPerRecord: 2,
+	}
+	require.NoError(t, k.Init())
+
+	r := []*kinesis.PutRecordsRequestEntry{}
+	expected := []byte{}
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("metric%d value=%di %d\n", i, i, i))
+		expected = append(expected, data...)
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String("partitionKey"),
+			Data:         data,
+		})
+	}
+
+	// the remaining metric goes into a record of its own
+	compressed, counts, dropped := k.compressRecords(r)
+	require.Zero(t, dropped)
+	require.Len(t, compressed, 3)
+	require.Equal(t, []int{2, 2, 1}, counts)
+
+	actual := []byte{}
+	for _, record := range compressed {
+		actual = append(actual, gunzip(t, record.Data)...)
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestCompressRecords_RecordsPerMetric(t *testing.T) {
+	k := KinesisOutput{
+		Log:              testutil.Logger{},
+		ContentEncoding:  "gzip",
+		RecordsPerMetric: true,
+	}
+	require.NoError(t, k.Init())
+
+	r := []*kinesis.PutRecordsRequestEntry{}
+	for i := 0; i < 4; i++ {
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(fmt.Sprintf("key%d", i%2)),
+			Data:         []byte(fmt.Sprintf("metric%d value=%di %d\n", i, i, i)),
+		})
+	}
+
+	compressed, counts, dropped := k.compressRecords(r)
+	require.Zero(t, dropped)
+	require.Len(t, compressed, 4)
+	require.Equal(t, []int{1, 1, 1, 1}, counts)
+
+	// records are grouped by partition key, keeping their order
+	for i, j := range []int{0, 2, 1, 3} {
+		require.Equal(t, aws.StringValue(r[j].PartitionKey), aws.StringValue(compressed[i].PartitionKey))
+		require.Equal(t, r[j].Data, gunzip(t, compressed[i].Data))
+	}
+}
+
+func TestInit_InvalidMaxMetricsPerRecord(t *testing.T) {
+	k := KinesisOutput{
+		Log:                 testutil.Logger{},
+		MaxMetricsPerRecord: -1,
+	}
+	require.Error(t, k.Init())
+}
+
+func TestInit_InvalidContentEncoding(t *testing.T) {
+	k := KinesisOutput{
+		Log:             testutil.Logger{},
+		ContentEncoding: "br",
+	}
+	require.Error(t, k.Init())
+}
+
+func TestCompressRecords_HeaderFields(t *testing.T) {
+	k := KinesisOutput{
+		Log:               testutil.Logger{},
+		ContentEncoding:   "gzip",
+		GzipHeaderName:    "pipeline-a",
+		GzipHeaderComment: "produced by télégraf",
+	}
+	require.NoError(t, k.Init())
+
+	compressed, _, dropped := k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String("key"), Data: []byte("cpu value=1 0\n")},
+	})
+	require.Zero(t, dropped)
+	require.Len(t, compressed, 1)
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed[0].Data))
+	require.NoError(t, err)
+	require.Equal(t, "pipeline-a", r.Name)
+	require.Equal(t, "produced by télégraf", r.Comment)
+	require.Equal(t, []byte("cpu value=1 0\n"), gunzip(t, compressed[0].Data))
+}
+
+func TestCompressRecords_HeaderFieldsCountTowardsLimit(t *testing.T) {
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+	}
+
+	// random data that only just fits in a record without header fields
+	key := "k"
+	data := randomGzipData(t, maxRecordSize-len(key))
+
+	compressed, _, dropped := k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String(key), Data: data},
+	})
+	require.Zero(t, dropped)
+	require.Len(t, compressed, 1)
+
+	k.GzipHeaderName = "pipeline-a"
+	compressed, _, dropped = k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String(key), Data: data},
+	})
+	require.Equal(t, 1, dropped)
+	require.Empty(t, compressed)
+}
+
+func TestInit_InvalidGzipHeaderField(t *testing.T) {
+	k := KinesisOutput{
+		Log:            testutil.Logger{},
+		GzipHeaderName: "pipeline ☃",
+	}
+	require.Error(t, k.Init())
+
+	k = KinesisOutput{
+		Log:               testutil.Logger{},
+		GzipHeaderComment: "null\x00byte",
+	}
+	require.Error(t, k.Init())
+}
+
+func TestCompressRecords_OversizedMetricCompressedAlone(t *testing.T) {
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+	}
+
+	small := []byte("cpu value=1 0\n")
+	large := bytes.Repeat([]byte("cpu value=1 0\n"), 2*maxRecordSize/14)
+	compressed, _, dropped := k.compressRecords([]*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String("key"), Data: small},
+		{PartitionKey: aws.String("key"), Data: large},
+		{PartitionKey: aws.String("key"), Data: small},
+	})
+	require.Zero(t, dropped)
+
+	// the large metric gets a record of its own, keeping the order
+	require.Len(t, compressed, 3)
+	require.Equal(t, small, gunzip(t, compressed[0].Data))
+	require.Equal(t, large, gunzip(t, compressed[1].Data))
+	require.Equal(t, small, gunzip(t, compressed[2].Data))
+	require.Less(t, len(compressed[1].Data), maxRecordSize)
+}
+
+func TestWrite_TimestampPrecision(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "partitionKey",
+		},
+		StreamName:         "stream",
+		ContentEncoding:    "gzip",
+		TimestampPrecision: internal.Duration{Duration: time.Second},
+		serializer:         influx.NewSerializer(),
+		svc:                svc,
+	}
+	require.NoError(t, k.Init())
+
+	metric := testutil.MustMetric("cpu",
+		map[string]string{},
+		map[string]interface{}{"value": 1},
+		time.Unix(1600000000, 700000000),
+	)
+	require.NoError(t, k.Write([]telegraf.Metric{metric}))
+
+	require.Len(t, svc.requests, 1)
+	require.Len(t, svc.requests[0].Records, 1)
+	require.Equal(t, "cpu value=1i 1600000001000000000\n", string(gunzip(t, svc.requests[0].Records[0].Data)))
+
+	// the metric in the agent buffer is not modified
+	require.Equal(t, time.Unix(1600000000, 700000000), metric.Time())
+}
+
+func TestInit_InvalidTimestampPrecision(t *testing.T) {
+	k := KinesisOutput{
+		Log:                testutil.Logger{},
+		TimestampPrecision: internal.Duration{Duration: 10 * time.Millisecond},
+	}
+	require.Error(t, k.Init())
+}
+
+func TestWrite_TimeBucket(t *testing.T) {
+	start := time.Unix(1600000020, 0)
+	metrics := []telegraf.Metric{}
+	for i, offset := range []time.Duration{0, 30 * time.Second, 60 * time.Second, 90 * time.Second} {
+		host := "a"
+		if i%2 == 1 {
+			host = "b"
+		}
+		metrics = append(metrics, testutil.MustMetric("cpu",
+			map[string]string{"host": host},
+			map[string]interface{}{"value": i},
+			start.Add(offset),
+		))
+	}
+
+	tests := []struct {
+		name      string
+		partition *Partition
+		expected  []string
+	}{
+		{
+			name:      "static",
+			partition: &Partition{Method: "static", Key: "static"},
+			expected: []string{
+				"cpu,host=a value=0i 1600000020000000000\ncpu,host=b value=1i 1600000050000000000\n",
+				"cpu,host=a value=2i 1600000080000000000\ncpu,host=b value=3i 1600000110000000000\n",
+			},
+		},
+		{
+			name:      "tag",
+			partition: &Partition{Method: "tag", Key: "host"},
+			expected: []string{
+				"cpu,host=a value=0i 1600000020000000000\n",
+				"cpu,host=b value=1i 1600000050000000000\n",
+				"cpu,host=a value=2i 1600000080000000000\n",
+				"cpu,host=b value=3i 1600000110000000000\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(uint32(len(tt.expected)), 0)
+
+			k := KinesisOutput{
+				Log:             testutil.Logger{},
+				Partition:       tt.partition,
+				StreamName:      "stream",
+				ContentEncoding: "gzip",
+				TimeBucket:      internal.Duration{Duration: time.Minute},
+				serializer:      influx.NewSerializer(),
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+			require.NoError(t, k.Write(metrics))
+
+			require.Len(t, svc.requests, 1)
+			records := []string{}
+			for _, record := range svc.requests[0].Records {
+				records = append(records, string(gunzip(t, record.Data)))
+			}
+			require.Equal(t, tt.expected, records)
+		})
+	}
+}
+
+func TestTimeBuckets_TimestampPrecision(t *testing.T) {
+	k := KinesisOutput{
+		ContentEncoding:    "gzip",
+		TimeBucket:         internal.Duration{Duration: time.Minute},
+		TimestampPrecision: internal.Duration{Duration: time.Second},
+	}
+
+	// the first metric is serialized with the timestamp of the next minute
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 1},
+			time.Unix(1600000019, 600000000)),
+		testutil.MustMetric("cpu", map[string]string{}, map[string]interface{}{"value": 2},
+			time.Unix(1600000020, 0)),
+	}
+	require.Len(t, k.timeBuckets(metrics), 1)
+
+	k.ContentEncoding = "identity"
+	require.Len(t, k.timeBuckets(metrics), 1)
+}
+
+func TestInit_InvalidTimeBucket(t *testing.T) {
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		TimeBucket: internal.Duration{Duration: -time.Minute},
+	}
+	require.Error(t, k.Init())
+}
+
+func TestWrite_RecordEncodingBase64(t *testing.T) {
+	for _, encoding := range []string{"identity", "gzip"} {
+		t.Run(encoding, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(2, 0)
+
+			k := KinesisOutput{
+				Log:             testutil.Logger{},
+				Partition:       &Partition{Method: "measurement"},
+				StreamName:      "stream",
+				ContentEncoding: encoding,
+				RecordEncoding:  "base64",
+				serializer:      serializer,
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+
+			metrics, metricsData := createTestMetrics(t, 2, serializer)
+			require.NoError(t, k.Write(metrics))
+
+			require.Len(t, svc.requests, 1)
+			require.Len(t, svc.requests[0].Records, 2)
+			for i, record := range svc.requests[0].Records {
+				data, err := base64.StdEncoding.DecodeString(string(record.Data))
+				require.NoError(t, err)
+				if encoding == "gzip" {
+					data = gunzip(t, data)
+				}
+				require.Equal(t, metricsData[i], data)
+			}
+		})
+	}
+}
+
+func TestCompressRecords_RecordEncodingBase64Limit(t *testing.T) {
+	k := KinesisOutput{
+		Log:             testutil.Logger{},
+		ContentEncoding: "gzip",
+		RecordEncoding:  "base64",
+	}
+	require.NoError(t, k.Init())
+
+	// incompressible data filling the record limit several times over
+	data := make([]byte, 64*1024)
+	random := rand.New(rand.NewSource(1))
+	r := []*kinesis.PutRecordsRequestEntry{}
+	for i := 0; i < 48; i++ {
+		random.Read(data)
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String("key"),
+			Data:         append([]byte{}, data...),
+		})
+	}
+
+	encoded, _, dropped := k.encodeRecords(r)
+	require.Zero(t, dropped)
+	require.Greater(t, len(encoded), 2)
+
+	var decompressed []byte
+	for _, record := range encoded {
+		require.LessOrEqual(t, k.recordSize(record), maxRecordSize)
+		data, err := base64.StdEncoding.DecodeString(string(record.Data))
+		require.NoError(t, err)
+		decompressed = append(decompressed, gunzip(t, data)...)
+	}
+	require.Len(t, decompressed, 48*len(data))
+}
+
+func TestInit_InvalidRecordEncoding(t *testing.T) {
+	k := KinesisOutput{
+		Log:            testutil.Logger{},
+		RecordEncoding: "hex",
+	}
+	require.Error(t, k.Init())
+
+	k.RecordEncoding = ""
+	require.NoError(t, k.Init())
+	require.Equal(t, "raw", k.RecordEncoding)
+}
+
+func TestWrite_Zstd(t *testing.T) {
+	// entropy tables trained on unrelated data with line protocol content
+	dictionaryFile := filepath.Join("testdata", "metrics.dict")
+	dictionary, err := ioutil.ReadFile(dictionaryFile)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		dictionary string
+	}{
+		{
+			name: "without dictionary",
+		},
+		{
+			name:       "with dictionary",
+			dictionary: dictionaryFile,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(1, 0)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:         "stream",
+				ContentEncoding:    "zstd",
+				ZstdDictionaryFile: tt.dictionary,
+				serializer:         serializer,
+				svc:                svc,
+			}
+			require.NoError(t, k.Init())
+
+			metrics, metricsData := createTestMetrics(t, 3, serializer)
+			require.NoError(t, k.Write(metrics))
+
+			require.Len(t, svc.requests, 1)
+			require.Len(t, svc.requests[0].Records, 1)
+			data := svc.requests[0].Records[0].Data
+
+			opts := []zstd.DOption{}
+			if tt.dictionary != "" {
+				// the record can not be decompressed without the dictionary
+				decoder, err := zstd.NewReader(nil)
+				require.NoError(t, err)
+				defer decoder.Close()
+				_, err = decoder.DecodeAll(data, nil)
+				require.Error(t, err)
+
+				opts = append(opts, zstd.WithDecoderDicts(dictionary))
+			}
+
+			decoder, err := zstd.NewReader(nil, opts...)
+			require.NoError(t, err)
+			defer decoder.Close()
+			decompressed, err := decoder.DecodeAll(data, nil)
+			require.NoError(t, err)
+			require.Equal(t, bytes.Join(metricsData, nil), decompressed)
+		})
+	}
+}
+
+func TestCompressRecords_ZstdRecordLimit(t *testing.T) {
+	k := KinesisOutput{
+		Log:             testutil.Logger{},
+		ContentEncoding: "zstd",
+	}
+	require.NoError(t, k.Init())
+
+	// incompressible data filling the record limit several times over
+	data := make([]byte, 64*1024)
+	random := rand.New(rand.NewSource(1))
+	r := []*kinesis.PutRecordsRequestEntry{}
+	for i := 0; i < 48; i++ {
+		random.Read(data)
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String("key"),
+			Data:         append([]byte{}, data...),
+		})
+	}
+
+	compressed, _, dropped := k.compressRecords(r)
+	require.Zero(t, dropped)
+	require.Greater(t, len(compressed), 2)
+	for _, record := range compressed {
+		require.LessOrEqual(t, k.recordSize(record), maxRecordSize)
+	}
+}
+
+func TestInit_InvalidZstdDictionary(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.dict")
+	require.NoError(t, ioutil.WriteFile(invalid, []byte("not a zstd dictionary"), 0600))
+
+	for _, tt := range []struct {
+		encoding   string
+		dictionary string
+	}{
+		{encoding: "zstd", dictionary: filepath.Join(t.TempDir(), "missing.dict")},
+		{encoding: "zstd", dictionary: invalid},
+		{encoding: "gzip", dictionary: filepath.Join("testdata", "metrics.dict")},
+	} {
+		k := KinesisOutput{
+			Log:                testutil.Logger{},
+			ContentEncoding:    tt.encoding,
+			ZstdDictionaryFile: tt.dictionary,
+		}
+		require.Error(t, k.Init(), tt.dictionary)
+	}
+}
+
+func TestWrite_MetricsPerRecord(t *testing.T) {
+	metrics := []telegraf.Metric{}
+	for i := 0; i < 6; i++ {
+		host := "a"
+		if i >= 4 {
+			host = "b"
+		}
+		metrics = append(metrics, testutil.MustMetric("cpu",
+			map[string]string{"host": host},
+			map[string]interface{}{"value": i},
+			time.Now(),
+		))
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 0)
+	svc.SetupGenericResponse(2, 0)
+	svc.SetupGenericResponse(6, 0)
+
+	k := KinesisOutput{
+		Log:             testutil.Logger{},
+		Partition:       &Partition{Method: "static", Key: "static"},
+		StreamName:      "packing",
+		ContentEncoding: "gzip",
+		serializer:      influx.NewSerializer(),
+		svc:             svc,
+	}
+	require.NoError(t, k.Init())
+	packed := k.metricsPacked.Get()
+	produced := k.recordsProduced.Get()
+
+	// all metrics share a key and are packed into a single record
+	require.NoError(t, k.Write(metrics))
+	require.Equal(t, packed+6, k.metricsPacked.Get())
+	require.Equal(t, produced+1, k.recordsProduced.Get())
+
+	// 4 and 2 metrics for the two hosts
+	k.Partition = &Partition{Method: "tag", Key: "host"}
+	require.NoError(t, k.Write(metrics))
+	require.Equal(t, packed+12, k.metricsPacked.Get())
+	require.Equal(t, produced+3, k.recordsProduced.Get())
+
+	k.ContentEncoding = "identity"
+	require.NoError(t, k.Write(metrics))
+	require.Equal(t, packed+18, k.metricsPacked.Get())
+	require.Equal(t, produced+9, k.recordsProduced.Get())
+	require.Len(t, svc.requests, 3)
+}
@@ -0,0 +1,68 @@
+package kinesis
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// openFallback opens fallback_file for appending, where "stdout" is standard
+// output.
+func (k *KinesisOutput) openFallback() error {
+	k.fallbackLock.Lock()
+	defer k.fallbackLock.Unlock()
+
+	if k.fallback != nil {
+		return nil
+	}
+
+	if k.FallbackFile == "stdout" {
+		k.fallback = os.Stdout
+		return nil
+	}
+
+	file, err := os.OpenFile(k.FallbackFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	k.fallback = file
+	k.fallbackCloser = file
+	return nil
+}
+
+// writeFallback writes the data of records that could not be sent to the
+// fallback file.
+func (k *KinesisOutput) writeFallback(r []*kinesis.PutRecordsRequestEntry) {
+	k.fallbackLock.Lock()
+	defer k.fallbackLock.Unlock()
+
+	if k.fallback == nil || len(r) == 0 {
+		return
+	}
+
+	for _, record := range r {
+		data, err := k.decodeRecord(record.Data)
+		if err != nil {
+			k.Log.Errorf("Unable to decode record for fallback file %q: %v", k.FallbackFile, err)
+			continue
+		}
+		if _, err := k.fallback.Write(data); err != nil {
+			k.Log.Errorf("Unable to write %d record(s) to fallback file %q: %v", len(r), k.FallbackFile, err)
+			return
+		}
+	}
+	k.Log.Debugf("Wrote %d unsent record(s) to fallback file %q", len(r), k.FallbackFile)
+}
+
+func (k *KinesisOutput) closeFallback() error {
+	k.fallbackLock.Lock()
+	defer k.fallbackLock.Unlock()
+
+	closer := k.fallbackCloser
+	k.fallback = nil
+	k.fallbackCloser = nil
+	if closer == nil {
+		return nil
+	}
+	return closer.Close()
+}
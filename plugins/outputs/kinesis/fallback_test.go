@@ -0,0 +1,176 @@
+package kinesis
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteKinesis_Fallback(t *testing.T) {
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: aws.String("partitionKey"),
+			Data:         []byte("metric1 value=1i 1\n"),
+		},
+		{
+			PartitionKey: aws.String("partitionKey"),
+			Data:         []byte("metric2 value=2i 2\n"),
+		},
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(svc *mockKinesisPutRecords)
+		expected string
+	}{
+		{
+			name: "all sent",
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupGenericResponse(2, 0)
+			},
+			expected: "",
+		},
+		{
+			name: "failed records",
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupGenericResponse(1, 1)
+			},
+			expected: "metric2 value=2i 2\n",
+		},
+		{
+			name: "request error",
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupErrorResponse(awserr.New("InternalFailure", "Internal Service Failure", nil))
+			},
+			expected: "metric1 value=1i 1\nmetric2 value=2i 2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "unsent.out")
+
+			svc := &mockKinesisPutRecords{}
+			tt.setup(svc)
+
+			k := KinesisOutput{
+				Log:          testutil.Logger{},
+				StreamName:   "stream",
+				FallbackFile: path,
+				svc:          svc,
+			}
+			require.NoError(t, k.Init())
+			require.NoError(t, k.openFallback())
+
+			k.writeRecords(records)
+			require.NoError(t, k.Close())
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(data))
+		})
+	}
+}
+
+func TestWrite_FallbackDecodesRecords(t *testing.T) {
+	for _, tt := range []struct {
+		contentEncoding string
+		recordEncoding  string
+	}{
+		{contentEncoding: "identity", recordEncoding: "base64"},
+		{contentEncoding: "gzip", recordEncoding: "raw"},
+		{contentEncoding: "gzip", recordEncoding: "base64"},
+		{contentEncoding: "zstd", recordEncoding: "raw"},
+	} {
+		t.Run(tt.contentEncoding+"/"+tt.recordEncoding, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "unsent.out")
+			serializer := influx.NewSerializer()
+
+			svc := &mockKinesisPutRecords{}
+			svc.SetupErrorResponse(awserr.New("InternalFailure", "Internal Service Failure", nil))
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:      "stream",
+				FallbackFile:    path,
+				ContentEncoding: tt.contentEncoding,
+				RecordEncoding:  tt.recordEncoding,
+				serializer:      serializer,
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+			require.NoError(t, k.openFallback())
+
+			metrics, metricsData := createTestMetrics(t, 3, serializer)
+			require.NoError(t, k.Write(metrics))
+			require.NoError(t, k.Close())
+
+			// the file holds the serialized metrics, readable by the file input
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, string(bytes.Join(metricsData, nil)), string(data))
+		})
+	}
+}
+
+func TestWrite_FallbackSkipsRecordsKeptInWAL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "unsent.out")
+	serializer := influx.NewSerializer()
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+
+	// room for three records in the log
+	entry := encodeWALEntry(&kinesis.PutRecordsRequestEntry{
+		Data:         metricsData[0],
+		PartitionKey: aws.String("partitionKey"),
+	})
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "Internal Service Failure", nil))
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "Internal Service Failure", nil))
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "partitionKey",
+		},
+		StreamName:       "stream",
+		FallbackFile:     path,
+		MinFlushBytes:    internal.Size{Size: 1},
+		BufferWALFile:    filepath.Join(dir, "kinesis.wal"),
+		BufferWALMaxSize: internal.Size{Size: 3 * int64(len(entry))},
+		serializer:       serializer,
+		svc:              svc,
+	}
+	require.NoError(t, k.Init())
+	require.NoError(t, k.openFallback())
+	require.NoError(t, k.openWAL())
+
+	// the failed records are kept in the log to be retried
+	require.NoError(t, k.Write(metrics))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	// and written to the file once they are dropped
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Close())
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	expected := bytes.Join(metricsData, nil)
+	require.Equal(t, string(expected)+string(expected), string(data))
+}
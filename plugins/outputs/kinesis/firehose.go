@@ -0,0 +1,85 @@
+package kinesis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// Limits set by AWS (https://docs.aws.amazon.com/firehose/latest/APIReference/API_PutRecordBatch.html)
+const (
+	maxFirehoseRecordSize  = 1000 * 1024
+	maxFirehoseRequestSize = 4 * 1024 * 1024
+)
+
+// firehoseClient sends records to a Firehose delivery stream through the
+// subset of the Kinesis API used by the output, so that batching,
+// compression and error handling are shared by both backends. Partition keys
+// are not sent, as delivery streams do not have them.
+type firehoseClient struct {
+	kinesisiface.KinesisAPI
+	svc firehoseiface.FirehoseAPI
+}
+
+func (c *firehoseClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	return c.PutRecordsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *firehoseClient) PutRecordsWithContext(ctx aws.Context, input *kinesis.PutRecordsInput, opts ...request.Option) (*kinesis.PutRecordsOutput, error) {
+	records := make([]*firehose.Record, 0, len(input.Records))
+	for _, record := range input.Records {
+		records = append(records, &firehose.Record{Data: record.Data})
+	}
+
+	resp, err := c.svc.PutRecordBatchWithContext(ctx, &firehose.PutRecordBatchInput{
+		DeliveryStreamName: input.StreamName,
+		Records:            records,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &kinesis.PutRecordsOutput{
+		FailedRecordCount: resp.FailedPutCount,
+		Records:           make([]*kinesis.PutRecordsResultEntry, 0, len(resp.RequestResponses)),
+	}
+	for _, entry := range resp.RequestResponses {
+		output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{
+			ErrorCode:      entry.ErrorCode,
+			ErrorMessage:   entry.ErrorMessage,
+			SequenceNumber: entry.RecordId,
+		})
+	}
+	return output, nil
+}
+
+func (c *firehoseClient) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	resp, err := c.svc.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: input.StreamName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	description := resp.DeliveryStreamDescription
+	if description == nil {
+		return &kinesis.DescribeStreamSummaryOutput{}, nil
+	}
+
+	encryptionType := kinesis.EncryptionTypeNone
+	encryption := description.DeliveryStreamEncryptionConfiguration
+	if encryption != nil && aws.StringValue(encryption.Status) == firehose.DeliveryStreamEncryptionStatusEnabled {
+		encryptionType = kinesis.EncryptionTypeKms
+	}
+
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName:     description.DeliveryStreamName,
+			StreamStatus:   description.DeliveryStreamStatus,
+			EncryptionType: aws.String(encryptionType),
+		},
+	}, nil
+}
@@ -0,0 +1,255 @@
+package kinesis
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type mockFirehoseResponse struct {
+	Output *firehose.PutRecordBatchOutput
+	Err    error
+}
+
+type mockFirehose struct {
+	firehoseiface.FirehoseAPI
+
+	requests  []*firehose.PutRecordBatchInput
+	responses []*mockFirehoseResponse
+
+	description *firehose.DeliveryStreamDescription
+	describeErr error
+}
+
+// SetupResponse queues a response with a record id for each successful
+// record followed by the given error codes.
+func (m *mockFirehose) SetupResponse(successful int, errorCodes ...string) {
+	entries := []*firehose.PutRecordBatchResponseEntry{}
+	for i := 0; i < successful; i++ {
+		entries = append(entries, &firehose.PutRecordBatchResponseEntry{
+			RecordId: aws.String(fmt.Sprintf("record-%d", i)),
+		})
+	}
+	for _, code := range errorCodes {
+		entries = append(entries, &firehose.PutRecordBatchResponseEntry{
+			ErrorCode:    aws.String(code),
+			ErrorMessage: aws.String("failed"),
+		})
+	}
+
+	m.responses = append(m.responses, &mockFirehoseResponse{
+		Output: &firehose.PutRecordBatchOutput{
+			FailedPutCount:   aws.Int64(int64(len(errorCodes))),
+			RequestResponses: entries,
+		},
+	})
+}
+
+func (m *mockFirehose) SetupErrorResponse(err error) {
+	m.responses = append(m.responses, &mockFirehoseResponse{
+		Err: err,
+	})
+}
+
+func (m *mockFirehose) PutRecordBatchWithContext(
+	_ aws.Context,
+	input *firehose.PutRecordBatchInput,
+	_ ...request.Option,
+) (*firehose.PutRecordBatchOutput, error) {
+
+	reqNum := len(m.requests)
+	if reqNum >= len(m.responses) {
+		return nil, fmt.Errorf("Response for request %+v not setup", reqNum)
+	}
+
+	m.requests = append(m.requests, input)
+
+	resp := m.responses[reqNum]
+	return resp.Output, resp.Err
+}
+
+func (m *mockFirehose) DescribeDeliveryStream(
+	input *firehose.DescribeDeliveryStreamInput,
+) (*firehose.DescribeDeliveryStreamOutput, error) {
+
+	if m.describeErr != nil {
+		return nil, m.describeErr
+	}
+	return &firehose.DescribeDeliveryStreamOutput{
+		DeliveryStreamDescription: m.description,
+	}, nil
+}
+
+func newFirehoseOutput(t *testing.T, svc *mockFirehose) *KinesisOutput {
+	k := &KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: "delivery",
+		Backend:    "firehose",
+		Partition:  &Partition{Method: "measurement"},
+		svc:        &firehoseClient{svc: svc},
+		serializer: influx.NewSerializer(),
+	}
+	require.NoError(t, k.Init())
+	return k
+}
+
+func TestInit_InvalidBackend(t *testing.T) {
+	k := KinesisOutput{
+		Log:     testutil.Logger{},
+		Backend: "sqs",
+	}
+	require.Error(t, k.Init())
+
+	k.Backend = ""
+	require.NoError(t, k.Init())
+	require.Equal(t, "kinesis", k.Backend)
+}
+
+func TestFirehose_Write(t *testing.T) {
+	svc := &mockFirehose{}
+	svc.SetupResponse(2)
+	k := newFirehoseOutput(t, svc)
+
+	metrics := []telegraf.Metric{
+		testutil.TestMetric(1, "cpu"),
+		testutil.TestMetric(2, "mem"),
+	}
+	require.NoError(t, k.Write(metrics))
+
+	require.Len(t, svc.requests, 1)
+	request := svc.requests[0]
+	require.Equal(t, "delivery", aws.StringValue(request.DeliveryStreamName))
+	require.Len(t, request.Records, 2)
+	for i, m := range metrics {
+		data, err := k.serializer.Serialize(m)
+		require.NoError(t, err)
+		require.Equal(t, data, request.Records[i].Data)
+	}
+}
+
+func TestFirehose_WriteFailures(t *testing.T) {
+	svc := &mockFirehose{}
+	svc.SetupResponse(1, firehose.ErrCodeServiceUnavailableException, "InternalFailure")
+	k := newFirehoseOutput(t, svc)
+
+	records := createWALRecords("a", "b", "c")
+	result := k.writeKinesis(k.StreamName, records)
+	require.Equal(t, 3, result.records)
+	require.Equal(t, 2, result.failed)
+	require.Equal(t, 1, result.throttled)
+	// partition keys are not sent and do not count towards the bytes written
+	require.Equal(t, int64(len(records[0].Data)), result.bytes)
+
+	svc.SetupErrorResponse(awserr.New(firehose.ErrCodeServiceUnavailableException, "slow down", nil))
+	result = k.writeKinesis(k.StreamName, records)
+	require.Equal(t, 3, result.failed)
+	require.Equal(t, 3, result.throttled)
+}
+
+func TestFirehose_DescribeStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption *firehose.DeliveryStreamEncryptionConfiguration
+		expected   string
+	}{
+		{
+			name:     "no encryption configuration",
+			expected: kinesis.EncryptionTypeNone,
+		},
+		{
+			name: "encryption disabled",
+			encryption: &firehose.DeliveryStreamEncryptionConfiguration{
+				Status: aws.String(firehose.DeliveryStreamEncryptionStatusDisabled),
+			},
+			expected: kinesis.EncryptionTypeNone,
+		},
+		{
+			name: "encryption enabled",
+			encryption: &firehose.DeliveryStreamEncryptionConfiguration{
+				Status: aws.String(firehose.DeliveryStreamEncryptionStatusEnabled),
+			},
+			expected: kinesis.EncryptionTypeKms,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockFirehose{
+				description: &firehose.DeliveryStreamDescription{
+					DeliveryStreamName:                    aws.String("delivery"),
+					DeliveryStreamStatus:                  aws.String(firehose.DeliveryStreamStatusActive),
+					DeliveryStreamEncryptionConfiguration: tt.encryption,
+				},
+			}
+			k := newFirehoseOutput(t, svc)
+
+			summary, err := k.describeStream(k.StreamName)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, aws.StringValue(summary.EncryptionType))
+			require.Equal(t, kinesis.StreamStatusActive, k.getStreamStatus())
+		})
+	}
+}
+
+func TestFirehose_ValidateStreamNotFound(t *testing.T) {
+	svc := &mockFirehose{
+		describeErr: awserr.New(firehose.ErrCodeResourceNotFoundException, "not found", nil),
+	}
+	k := newFirehoseOutput(t, svc)
+	k.ConnectMaxRetries = 3
+
+	err := k.validateStream()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "must be created before starting telegraf")
+}
+
+func TestFirehose_Limits(t *testing.T) {
+	k := newFirehoseOutput(t, &mockFirehose{})
+
+	// records are limited to 1000KiB regardless of the partition key
+	require.Equal(t, maxFirehoseRecordSize, k.recordDataLimit("a long partition key"))
+
+	record := &kinesis.PutRecordsRequestEntry{
+		PartitionKey: aws.String("key"),
+		Data:         make([]byte, maxFirehoseRecordSize),
+	}
+	r := []*kinesis.PutRecordsRequestEntry{}
+	for i := 0; i < 5; i++ {
+		r = append(r, record)
+	}
+
+	batches := k.batchRecords(r)
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 4)
+	require.Len(t, batches[1], 1)
+}
+
+func TestFirehose_ResolveEndpointURL(t *testing.T) {
+	for _, env := range []string{"AWS_ENDPOINT_URL_KINESIS", "AWS_ENDPOINT_URL_FIREHOSE", "AWS_ENDPOINT_URL"} {
+		value, ok := os.LookupEnv(env)
+		os.Unsetenv(env)
+		if ok {
+			defer os.Setenv(env, value)
+		} else {
+			defer os.Unsetenv(env)
+		}
+	}
+	os.Setenv("AWS_ENDPOINT_URL_KINESIS", "http://kinesis:4566")
+	os.Setenv("AWS_ENDPOINT_URL_FIREHOSE", "http://firehose:4566")
+
+	k := KinesisOutput{Backend: "firehose"}
+	endpointURL, source := k.resolveEndpointURL()
+	require.Equal(t, "http://firehose:4566", endpointURL)
+	require.Equal(t, "AWS_ENDPOINT_URL_FIREHOSE", source)
+}
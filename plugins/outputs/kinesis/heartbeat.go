@@ -0,0 +1,76 @@
+package kinesis
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// Partition key used for heartbeat records when heartbeat_partition_key is
+// not set.
+const defaultHeartbeatPartitionKey = "__telegraf_heartbeat__"
+
+// heartbeatPeriodically sends a heartbeat record on every tick for which no
+// records were sent since the previous tick, until the plugin is closed.
+func (k *KinesisOutput) heartbeatPeriodically(ticks <-chan time.Time) {
+	for {
+		select {
+		case <-k.ctx.Done():
+			return
+		case now := <-ticks:
+			if !k.takeRecordsSent() {
+				k.sendHeartbeat(now)
+			}
+		}
+	}
+}
+
+func (k *KinesisOutput) sendHeartbeat(now time.Time) {
+	m, err := metric.New(
+		"kinesis_heartbeat",
+		map[string]string{},
+		map[string]interface{}{"alive": true},
+		now,
+	)
+	if err != nil {
+		k.Log.Errorf("Unable to create heartbeat metric: %v", err)
+		return
+	}
+
+	data, err := k.serialize(m)
+	if err != nil {
+		k.Log.Errorf("Unable to serialize heartbeat metric: %v", err)
+		return
+	}
+
+	partitionKey := k.HeartbeatPartitionKey
+	if partitionKey == "" {
+		partitionKey = defaultHeartbeatPartitionKey
+	}
+
+	r, _, _ := k.encodeRecords([]*kinesis.PutRecordsRequestEntry{
+		{
+			Data:         data,
+			PartitionKey: aws.String(partitionKey),
+		},
+	})
+
+	k.Log.Debugf("No records sent in the last %s, sending heartbeat", k.HeartbeatInterval.Duration)
+	k.writeRecords(r)
+
+	// the heartbeat does not count as activity, so another one is sent if
+	// nothing else is written during the next interval
+	k.takeRecordsSent()
+}
+
+// takeRecordsSent reports whether records were sent since the last call.
+func (k *KinesisOutput) takeRecordsSent() bool {
+	k.heartbeatLock.Lock()
+	defer k.heartbeatLock.Unlock()
+
+	sent := k.recordsSent
+	k.recordsSent = false
+	return sent
+}
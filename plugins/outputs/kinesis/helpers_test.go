@@ -0,0 +1,45 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/parsers/influx"
+	"github.com/stretchr/testify/require"
+)
+
+// partitionKeySequences parses the influx formatted records of the requests
+// and returns the metrics sent for each partition key, in the order they
+// were sent.
+func partitionKeySequences(t *testing.T, requests []*kinesis.PutRecordsInput) map[string][]telegraf.Metric {
+	t.Helper()
+
+	parser := influx.NewParser(influx.NewMetricHandler())
+	sequences := map[string][]telegraf.Metric{}
+	for _, req := range requests {
+		for _, record := range req.Records {
+			metrics, err := parser.Parse(record.Data)
+			require.NoError(t, err)
+
+			key := aws.StringValue(record.PartitionKey)
+			sequences[key] = append(sequences[key], metrics...)
+		}
+	}
+	return sequences
+}
+
+// assertPerKeyOrdering asserts that the metrics sent for each partition key
+// are in timestamp order, which Kinesis preserves within a shard.
+func assertPerKeyOrdering(t *testing.T, requests []*kinesis.PutRecordsInput) {
+	t.Helper()
+
+	for key, metrics := range partitionKeySequences(t, requests) {
+		for i := 1; i < len(metrics); i++ {
+			require.False(t, metrics[i].Time().Before(metrics[i-1].Time()),
+				"metric %d for partition key %q at %s was sent after a metric at %s",
+				i, key, metrics[i].Time(), metrics[i-1].Time())
+		}
+	}
+}
@@ -1,24 +1,60 @@
 package kinesis
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/gofrs/uuid"
 	"github.com/influxdata/telegraf"
 	internalaws "github.com/influxdata/telegraf/config/aws"
+	"github.com/influxdata/telegraf/internal"
 	"github.com/influxdata/telegraf/plugins/outputs"
 	"github.com/influxdata/telegraf/plugins/serializers"
+	"github.com/influxdata/telegraf/plugins/serializers/graphite"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/plugins/serializers/msgpack"
+	"github.com/influxdata/telegraf/plugins/serializers/prometheusremotewrite"
+	"github.com/influxdata/telegraf/selfstat"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Limit set by AWS (https://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html)
 const maxRecordsPerRequest uint32 = 500
 
+// Limit set by AWS (https://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html)
+const maxRequestSize = 5 * 1024 * 1024
+
+// Limit set by AWS (https://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecordsRequestEntry.html)
+const maxPartitionKeyLength = 256
+
+// defaultWALMaxSize bounds the write-ahead log when buffer_wal_max_size is
+// not set.
+const defaultWALMaxSize = 32 * 1024 * 1024
+
 type (
 	KinesisOutput struct {
 		Region      string `toml:"region"`
+		PartitionID string `toml:"partition_id"`
 		AccessKey   string `toml:"access_key"`
 		SecretKey   string `toml:"secret_key"`
 		RoleARN     string `toml:"role_arn"`
@@ -26,22 +62,174 @@ type (
 		Filename    string `toml:"shared_credential_file"`
 		Token       string `toml:"token"`
 		EndpointURL string `toml:"endpoint_url"`
+		UserAgent   string `toml:"user_agent"`
+
+		Backend string `toml:"backend"`
+
+		SigningName   string `toml:"signing_name"`
+		SigningRegion string `toml:"signing_region"`
 
 		StreamName         string     `toml:"streamname"`
+		StreamNames        []string   `toml:"stream_names"`
+		StreamStrategy     string     `toml:"stream_strategy"`
 		PartitionKey       string     `toml:"partitionkey"`
 		RandomPartitionKey bool       `toml:"use_random_partitionkey"`
 		Partition          *Partition `toml:"partition"`
+		PartitionKeyPrefix string     `toml:"partition_key_prefix"`
+		PartitionTemplate  string     `toml:"partition_key_template"`
 		Debug              bool       `toml:"debug"`
 
+		ConnectJitter       internal.Duration `toml:"connect_jitter"`
+		ConnectMaxRetries   int               `toml:"connect_max_retries"`
+		StreamCheckInterval internal.Duration `toml:"stream_check_interval"`
+		EncryptionRequired  bool              `toml:"encryption_required"`
+
+		HeartbeatInterval     internal.Duration `toml:"heartbeat_interval"`
+		HeartbeatPartitionKey string            `toml:"heartbeat_partition_key"`
+
+		SerializeErrorBehavior string `toml:"serialize_error_behavior"`
+		LogSequenceNumbers     bool   `toml:"log_sequence_numbers"`
+
+		PutRecordsTimeout internal.Duration `toml:"put_records_timeout"`
+		MaxMetricAge      internal.Duration `toml:"max_metric_age"`
+
+		IdleConnTimeout internal.Duration `toml:"idle_conn_timeout"`
+		MaxIdleConns    int               `toml:"max_idle_conns"`
+		KeepAlive       internal.Duration `toml:"keep_alive"`
+
+		TimestampPrecision   internal.Duration `toml:"timestamp_precision"`
+		SkipOversizedMetrics bool              `toml:"skip_oversized_metrics"`
+
+		MeasurementRename map[string]string `toml:"measurement_rename"`
+
+		MinFlushBytes       internal.Size     `toml:"min_flush_bytes"`
+		MaxBufferAge        internal.Duration `toml:"max_buffer_age"`
+		FlushMetricCount    int               `toml:"flush_metric_count"`
+		BufferWALFile       string            `toml:"buffer_wal_file"`
+		BufferWALMaxSize    internal.Size     `toml:"buffer_wal_max_size"`
+		BufferFlushInterval internal.Duration `toml:"buffer_flush_interval"`
+
+		MaxMetricsPerWrite int  `toml:"max_metrics_per_write"`
+		MaxKeysPerRequest  int  `toml:"max_partition_keys_per_request"`
+		ReturnErrorsOnDrop bool `toml:"return_errors_on_drop"`
+		Strict             bool `toml:"strict"`
+		RetryOnThrottle    bool `toml:"retry_on_throttle"`
+		LogFlushSummary    bool `toml:"log_flush_summary"`
+
+		ReshuffleFailedOnRetry bool `toml:"reshuffle_failed_on_retry"`
+
+		FallbackFile    string `toml:"fallback_file"`
+		ContentEncoding string `toml:"content_encoding"`
+		RecordEncoding  string `toml:"record_encoding"`
+
+		GzipHeaderName    string `toml:"gzip_header_name"`
+		GzipHeaderComment string `toml:"gzip_header_comment"`
+
+		TimeBucket          internal.Duration `toml:"time_bucket"`
+		MaxMetricsPerRecord int               `toml:"max_metrics_per_record"`
+		RecordsPerMetric    bool              `toml:"records_per_metric"`
+
+		ZstdDictionaryFile string `toml:"zstd_dictionary_file"`
+
+		LogSuppressionWindow internal.Duration `toml:"log_suppression_window"`
+		LogLifecycleEvents   bool              `toml:"log_lifecycle_events"`
+
+		PartialFailureLogThreshold float64 `toml:"partial_failure_log_threshold"`
+
+		Async             bool              `toml:"async"`
+		AsyncQueueSize    int               `toml:"async_queue_size"`
+		AsyncFullBehavior string            `toml:"async_full_behavior"`
+		AsyncCloseTimeout internal.Duration `toml:"async_close_timeout"`
+
+		CircuitBreakerThreshold int               `toml:"circuit_breaker_threshold"`
+		CircuitBreakerCooldown  internal.Duration `toml:"circuit_breaker_cooldown"`
+
 		Log        telegraf.Logger `toml:"-"`
 		serializer serializers.Serializer
 		svc        kinesisiface.KinesisAPI
+
+		// injectedSvc is the client given to New, which Connect uses instead
+		// of creating one.
+		injectedSvc kinesisiface.KinesisAPI
+
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+
+		endpoint    string
+		credentials *credentials.Credentials
+
+		statusLock   sync.Mutex
+		streamStatus map[string]string
+
+		breaker           *circuitBreaker
+		logLimiter        *logLimiter
+		zstdEncoder       *zstd.Encoder
+		zstdDecoder       *zstd.Decoder
+		partitionTemplate *template.Template
+		resolver          endpoints.Resolver
+
+		connectRetryDelay time.Duration
+
+		bufferLock    sync.Mutex
+		buffer        []*kinesis.PutRecordsRequestEntry
+		bufferCounts  []int
+		bufferBytes   int64
+		bufferMetrics int
+		bufferStart   time.Time
+		wal           *writeAheadLog
+
+		// serializerLock guards the serializer, which is also used by the
+		// heartbeat outside of Write.
+		serializerLock sync.Mutex
+
+		heartbeatLock sync.Mutex
+		recordsSent   bool
+
+		nextStream uint32
+
+		// throttledKeys collects the partition keys of records throttled
+		// during a write, which become the hotKeys given random partition
+		// keys in the next write.
+		hotKeysLock   sync.Mutex
+		hotKeys       map[string]bool
+		throttledKeys map[string]bool
+
+		// queueLock is held for reading while records are queued and for
+		// writing while the queue is created or closed.
+		queueLock sync.RWMutex
+		queue     chan []*kinesis.PutRecordsRequestEntry
+		asyncDone chan struct{}
+		asyncStop chan struct{}
+
+		fallbackLock   sync.Mutex
+		fallback       io.Writer
+		fallbackCloser io.Closer
+
+		serializeErrors     selfstat.Stat
+		staleMetricsDropped selfstat.Stat
+		bytesWritten        selfstat.Stat
+		recordsFailed       selfstat.Stat
+		uuidErrors          selfstat.Stat
+		asyncDropped        selfstat.Stat
+		walDropped          selfstat.Stat
+		shardFanout         selfstat.Stat
+		metricsPacked       selfstat.Stat
+		recordsProduced     selfstat.Stat
+		events              map[string]selfstat.Stat
+
+		newUUID      func() (uuid.UUID, error)
+		fallbackKeys uint32
 	}
 
 	Partition struct {
 		Method  string `toml:"method"`
 		Key     string `toml:"key"`
 		Default string `toml:"default"`
+
+		Keys        []string `toml:"keys"`
+		Separator   string   `toml:"separator"`
+		MissingTags string   `toml:"missing_tags"`
 	}
 )
 
@@ -49,6 +237,11 @@ var sampleConfig = `
   ## Amazon REGION of kinesis endpoint.
   region = "ap-southeast-2"
 
+  ## AWS partition the region belongs to, one of "aws", "aws-us-gov" or
+  ## "aws-cn". When set, endpoints are only resolved within this partition
+  ## and the region must belong to it.
+  # partition_id = ""
+
   ## Amazon Credentials
   ## Credentials are loaded in the following order
   ## 1) Assumed credentials via STS if role_arn is specified
@@ -66,18 +259,44 @@ var sampleConfig = `
 
   ## Endpoint to make request against, the correct endpoint is automatically
   ## determined and this option should only be set if you wish to override the
-  ## default.
+  ## default. When unset, the AWS_ENDPOINT_URL_KINESIS and AWS_ENDPOINT_URL
+  ## environment variables are used if present.
   ##   ex: endpoint_url = "http://localhost:8000"
   # endpoint_url = ""
 
+  ## Text appended to the User-Agent of requests sent to Kinesis, defaults to
+  ## the Telegraf version and plugin name.
+  # user_agent = ""
+
+  ## Override the service name and region used to sign requests, for
+  ## Kinesis compatible endpoints that expect values different from the
+  ## resolved endpoint.
+  # signing_name = ""
+  # signing_region = ""
+
   ## Kinesis StreamName must exist prior to starting telegraf.
   streamname = "StreamName"
+  ## Service records are sent to, either "kinesis" for a Kinesis data stream
+  ## or "firehose" for a Firehose delivery stream named by streamname.
+  # backend = "kinesis"
+  ## Streams to distribute records across instead of a single streamname,
+  ## either in turn with the "round_robin" strategy or by the hash of the
+  ## partition key with "hash".
+  # stream_names = ["StreamName1", "StreamName2"]
+  # stream_strategy = "round_robin"
   ## DEPRECATED: PartitionKey as used for sharding data.
   partitionkey = "PartitionKey"
   ## DEPRECATED: If set the partitionKey will be a random UUID on every put.
   ## This allows for scaling across multiple shards in a stream.
   ## This will cause issues with ordering.
   use_random_partitionkey = false
+  ## Prefix prepended to every partition key regardless of the partition
+  ## method. The resulting key is truncated to the 256 byte Kinesis limit.
+  # partition_key_prefix = ""
+  ## Go template used to compute the partition key of each metric instead of
+  ## the partition method, with access to .Name, .Tag, .Tags, .Field, .Fields
+  ## and .Time. An empty result uses the partition default, or "telegraf".
+  # partition_key_template = '{{ .Tag "region" }}-{{ .Name }}'
   ## The partition key can be calculated using one of several methods:
   ##
   ## Use a static value for all writes:
@@ -99,7 +318,24 @@ var sampleConfig = `
   #    method = "tag"
   #    key = "host"
   #    default = "mykey"
-
+  #
+  ## Use the values of several tags joined by the separator, "/" by default.
+  ## If any of the tags is not set the default option will be used, or with
+  ## missing_tags = "empty" the missing tags are left empty.
+  #  [outputs.kinesis.partition]
+  #    method = "tag"
+  #    keys = ["region", "service"]
+  #    separator = "/"
+  #    missing_tags = "default"
+  #    default = "mykey"
+  #
+  ## Use the measurement name and the value of a tag, joined by a "/". If the
+  ## tag is not set the default option will be used, or "telegraf" when no
+  ## default is set.
+  #  [outputs.kinesis.partition]
+  #    method = "measurement_tag"
+  #    key = "tenant"
+  #    default = "mykey"
 
   ## Data format to output.
   ## Each data format has its own unique set of configuration options, read
@@ -109,8 +345,219 @@ var sampleConfig = `
 
   ## debug will show upstream aws messages.
   debug = false
+
+  ## Maximum amount of time to wait before validating the stream on connect.
+  ## Each agent sleeps a random duration up to this value, which spreads out
+  ## DescribeStreamSummary calls when many agents start at the same time.
+  # connect_jitter = "0s"
+
+  ## Number of times validating the stream is retried after a transient
+  ## error when connecting. The first retry waits one second and the wait
+  ## doubles before each following retry.
+  # connect_max_retries = 0
+
+  ## Interval at which the stream is re-validated with DescribeStreamSummary
+  ## after connecting. A warning is logged when the stream status changes, for
+  ## example when the stream is being deleted. Disabled when set to "0s".
+  # stream_check_interval = "0s"
+
+  ## Fail to connect when the stream is not encrypted at rest. The stream
+  ## encryption type is logged when connecting either way.
+  # encryption_required = false
+
+  ## Send a small heartbeat record when no records were sent during an
+  ## interval, as a liveness signal for consumers. Heartbeats are serialized
+  ## kinesis_heartbeat metrics. Disabled when set to "0s".
+  # heartbeat_interval = "0s"
+  # heartbeat_partition_key = "__telegraf_heartbeat__"
+
+  ## Behavior when a metric cannot be serialized, one of:
+  ##   "skip"  - log the error and drop the metric (default)
+  ##   "error" - return the error from the write, leaving the metrics buffered
+  # serialize_error_behavior = "skip"
+
+  ## Log the shard id and sequence number assigned to each written record at
+  ## debug level. This is verbose and intended for correlating producer and
+  ## consumer logs.
+  # log_sequence_numbers = false
+
+  ## Maximum amount of time a single PutRecords call may take before it is
+  ## abandoned. Disabled when set to "0s".
+  # put_records_timeout = "0s"
+
+  ## Tuning of the connections to Kinesis. Idle connections are closed after
+  ## idle_conn_timeout, up to max_idle_conns are kept open for reuse, and TCP
+  ## keep-alive probes are sent every keep_alive. A negative keep_alive
+  ## disables the probes.
+  # idle_conn_timeout = "90s"
+  # max_idle_conns = 100
+  # keep_alive = "30s"
+
+  ## Metrics with a timestamp older than this are dropped instead of being
+  ## sent, for example when replaying a buffer after an outage. Disabled when
+  ## set to "0s".
+  # max_metric_age = "0s"
+
+  ## Round metric timestamps to this precision before they are serialized,
+  ## one of "1ns", "1us", "1ms" or "1s". Timestamps are not changed when unset.
+  # timestamp_precision = "1ns"
+
+  ## Drop metrics that are certainly larger than a record before serializing
+  ## them, from a lower bound of their size. Only used without compression,
+  ## and not with the graphite or prometheusremotewrite data formats.
+  # skip_oversized_metrics = false
+
+  ## Hold records across writes until at least this many bytes are buffered,
+  ## reducing the number of small PutRecords calls on low volume streams.
+  ## Buffered records are acknowledged to Telegraf before they are sent and
+  ## are lost if the agent exits without closing the output. Disabled when
+  ## set to 0.
+  # min_flush_bytes = 0
+  ## Buffered records are sent on the next write once the oldest of them has
+  ## been held for this long, even if min_flush_bytes has not been reached.
+  # max_buffer_age = "0s"
+  ## Buffered records are sent once this many metrics are buffered, even if
+  ## min_flush_bytes has not been reached. Disabled when set to 0.
+  # flush_metric_count = 0
+  ## Interval at which buffered records are sent even if no new write
+  ## arrives. Disabled when set to "0s".
+  # buffer_flush_interval = "0s"
+  ## Path of a write-ahead log where buffered records are persisted until
+  ## they are sent. Records left in the log, for example after a crash, are
+  ## replayed when connecting. The log is limited to buffer_wal_max_size and
+  ## records that do not fit are only held in memory. Records of failed
+  ## requests are retried while the buffer holds less than
+  ## buffer_wal_max_size, and dropped otherwise.
+  # buffer_wal_file = ""
+  # buffer_wal_max_size = "32MiB"
+
+  ## Maximum number of metrics serialized at once. Larger writes are split
+  ## into chunks of this size to bound memory use. Disabled when set to 0.
+  # max_metrics_per_write = 0
+
+  ## Maximum number of distinct partition keys in a single PutRecords call.
+  ## A new request is started once the limit is reached, so a batch is not
+  ## spread thinly across many shards. Disabled when set to 0.
+  # max_partition_keys_per_request = 0
+
+  ## Return an error from the write when records fail to be sent or metrics
+  ## are dropped, other than for max_metric_age or empty serializer output,
+  ## so the failure is reported by the agent. Telegraf retries
+  ## the whole write, so records that were sent may be sent again.
+  # return_errors_on_drop = false
+
+  ## Fail the write when any metric is dropped, other than for max_metric_age
+  ## or empty serializer output, so Telegraf retries the whole write. Nothing is sent when a metric can
+  ## not be serialized or is too large, but records that were sent before
+  ## others failed are sent again with the retry.
+  # strict = false
+
+  ## Return an error from the write when Kinesis throttles any record, or a
+  ## request exceeds put_records_timeout or gets a response without a result
+  ## for every record, so Telegraf keeps the metrics buffered and retries
+  ## them on the next flush.
+  ## The agent buffer grows while the stream is throttled, up to
+  ## metric_buffer_limit, and records that were sent may be sent again.
+  # retry_on_throttle = false
+
+  ## With retry_on_throttle, give random partition keys to the metrics whose
+  ## partition key was throttled by Kinesis in the previous write, so that
+  ## the retry is spread across shards instead of hitting a hot shard again.
+  # reshuffle_failed_on_retry = false
+
+  ## File where the data of records that could not be sent is appended, or
+  ## "stdout" for standard output. Records are decoded and decompressed, so
+  ## the data is written as produced by the serializer. Disabled when empty.
+  # fallback_file = ""
+
+  ## Content encoding of the record data, "identity", "gzip" or "zstd". With
+  ## "gzip" or "zstd" the metrics sharing a partition key are packed into
+  ## compressed records of up to 1MiB, instead of one record per metric.
+  # content_encoding = "identity"
+
+  ## Name and comment stored in the header of gzip compressed records.
+  # gzip_header_name = ""
+  # gzip_header_comment = ""
+
+  ## Encoding of the record data once the content encoding is applied, "raw"
+  ## or "base64". Base64 makes the data about a third larger, which is
+  ## accounted for in the record limit.
+  # record_encoding = "raw"
+
+  ## With "gzip" or "zstd", only pack metrics whose timestamps fall in the
+  ## same window of this length into a record. Disabled when set to 0.
+  # time_bucket = "0s"
+
+  ## With "gzip" or "zstd", maximum number of metrics packed into a record,
+  ## bounding the work consumers do per record. Disabled when set to 0.
+  # max_metrics_per_record = 0
+
+  ## With "gzip" or "zstd", compress every metric into a record of its own
+  ## instead of packing them, for consumers that need one metric per record.
+  # records_per_metric = false
+
+  ## Dictionary trained with "zstd --train" used to compress records with
+  ## "zstd". Consumers must decompress the records with the same dictionary.
+  # zstd_dictionary_file = ""
+
+  ## Log a single line per write summarizing the metrics, records, requests,
+  ## failures, retries and bytes sent.
+  # log_flush_summary = false
+
+  ## Interval in which repeated errors writing to Kinesis are logged once,
+  ## with the number of similar messages suppressed reported with the next
+  ## one. Disabled when set to 0.
+  # log_suppression_window = "0s"
+
+  ## Fraction of the records of a request that must fail before the partial
+  ## failure is logged, as a warning. Failures are counted in the
+  ## records_failed internal metric either way. When set to 0 every partial
+  ## failure is logged as an error.
+  # partial_failure_log_threshold = 0.0
+
+  ## Log lifecycle events, such as connecting or the stream becoming
+  ## inactive, as key=value pairs. Events are counted in the
+  ## lifecycle_events internal metric either way.
+  # log_lifecycle_events = false
+
+  ## Return from writes immediately, sending the records in the background.
+  ## Up to async_queue_size writes are queued, and when the queue is full the
+  ## records are dropped, or with async_full_behavior = "block" the write
+  ## waits. Failed records are not reported to Telegraf. On shutdown queued
+  ## writes are sent for up to async_close_timeout.
+  # async = false
+  # async_queue_size = 10
+  # async_full_behavior = "drop"
+  # async_close_timeout = "5s"
+
+  ## Number of consecutive writes in which every record failed before writes
+  ## are paused. While paused, writes fail immediately so Telegraf keeps the
+  ## metrics buffered. After the cooldown one write is attempted, and a
+  ## success resumes normal operation. Disabled when set to 0.
+  # circuit_breaker_threshold = 0
+  # circuit_breaker_cooldown = "1m"
+
+  ## Measurements to rename before metrics are serialized, from the name on
+  ## the left to the name on the right. Partition keys are computed from the
+  ## new name. Prefixes and suffixes can be added with the name_prefix and
+  ## name_suffix options common to all outputs.
+  # [outputs.kinesis.measurement_rename]
+  #   cpu = "prod.cpu"
 `
 
+// New returns an output that sends records with the given client and
+// serializer, for embedding the output or testing it without AWS. When the
+// client is nil Connect creates one from the configuration as usual, and when
+// the serializer is nil it must be set with SetSerializer. The configuration
+// is set on the returned output before calling Init and Connect.
+func New(svc kinesisiface.KinesisAPI, serializer serializers.Serializer) *KinesisOutput {
+	return &KinesisOutput{
+		serializer:  serializer,
+		svc:         svc,
+		injectedSvc: svc,
+	}
+}
+
 func (k *KinesisOutput) SampleConfig() string {
 	return sampleConfig
 }
@@ -119,17 +566,289 @@ func (k *KinesisOutput) Description() string {
 	return "Configuration for the AWS Kinesis output."
 }
 
+func (k *KinesisOutput) Init() error {
+	switch k.SerializeErrorBehavior {
+	case "":
+		k.SerializeErrorBehavior = "skip"
+	case "skip", "error":
+	default:
+		return fmt.Errorf("invalid serialize_error_behavior %q", k.SerializeErrorBehavior)
+	}
+
+	switch k.Backend {
+	case "":
+		k.Backend = "kinesis"
+	case "kinesis", "firehose":
+	default:
+		return fmt.Errorf("invalid backend %q", k.Backend)
+	}
+
+	switch k.ContentEncoding {
+	case "":
+		k.ContentEncoding = "identity"
+	case "identity", "gzip", "zstd":
+	default:
+		return fmt.Errorf("invalid content_encoding %q", k.ContentEncoding)
+	}
+
+	if k.ZstdDictionaryFile != "" && k.ContentEncoding != "zstd" {
+		return fmt.Errorf("zstd_dictionary_file requires content_encoding to be zstd")
+	}
+	if k.ContentEncoding == "zstd" {
+		encoder, decoder, err := k.newZstdCodec()
+		if err != nil {
+			return fmt.Errorf("unable to load zstd_dictionary_file %q: %v", k.ZstdDictionaryFile, err)
+		}
+		k.zstdEncoder, k.zstdDecoder = encoder, decoder
+	}
+
+	switch k.RecordEncoding {
+	case "":
+		k.RecordEncoding = "raw"
+	case "raw", "base64":
+	default:
+		return fmt.Errorf("invalid record_encoding %q", k.RecordEncoding)
+	}
+
+	if !validGzipHeaderField(k.GzipHeaderName) {
+		return fmt.Errorf("invalid gzip_header_name %q, only characters U+0001 to U+00FF are allowed", k.GzipHeaderName)
+	}
+	if !validGzipHeaderField(k.GzipHeaderComment) {
+		return fmt.Errorf("invalid gzip_header_comment %q, only characters U+0001 to U+00FF are allowed", k.GzipHeaderComment)
+	}
+
+	if k.PartitionID != "" {
+		resolver, err := partitionResolver(k.PartitionID, k.Region)
+		if err != nil {
+			return err
+		}
+		k.resolver = resolver
+	}
+
+	if len(k.StreamNames) > 0 && k.StreamName != "" {
+		return fmt.Errorf("streamname and stream_names can not both be set")
+	}
+
+	switch k.StreamStrategy {
+	case "":
+		k.StreamStrategy = "round_robin"
+	case "round_robin", "hash":
+	default:
+		return fmt.Errorf("invalid stream_strategy %q", k.StreamStrategy)
+	}
+
+	if k.Partition != nil && len(k.Partition.Keys) > 0 {
+		if k.Partition.Method != "tag" {
+			return fmt.Errorf("partition keys can only be used with the tag method")
+		}
+		if k.Partition.Key != "" {
+			return fmt.Errorf("partition key and keys can not both be set")
+		}
+		if k.Partition.Separator == "" {
+			k.Partition.Separator = "/"
+		}
+		switch k.Partition.MissingTags {
+		case "":
+			k.Partition.MissingTags = "default"
+		case "default", "empty":
+		default:
+			return fmt.Errorf("invalid partition missing_tags %q", k.Partition.MissingTags)
+		}
+	}
+
+	if k.PartitionTemplate != "" {
+		tmpl, err := template.New("partition_key_template").Parse(k.PartitionTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid partition_key_template: %v", err)
+		}
+		k.partitionTemplate = tmpl
+	}
+
+	switch k.TimestampPrecision.Duration {
+	case 0, time.Nanosecond, time.Microsecond, time.Millisecond, time.Second:
+	default:
+		return fmt.Errorf("invalid timestamp_precision %s, must be one of 1ns, 1us, 1ms or 1s",
+			k.TimestampPrecision.Duration)
+	}
+
+	if k.ReshuffleFailedOnRetry && !k.RetryOnThrottle {
+		return fmt.Errorf("reshuffle_failed_on_retry requires retry_on_throttle to be set")
+	}
+
+	if k.PartialFailureLogThreshold < 0 || k.PartialFailureLogThreshold > 1 {
+		return fmt.Errorf("invalid partial_failure_log_threshold %g, must be between 0 and 1",
+			k.PartialFailureLogThreshold)
+	}
+
+	if k.TimeBucket.Duration < 0 {
+		return fmt.Errorf("invalid time_bucket %s, must not be negative", k.TimeBucket.Duration)
+	}
+
+	if k.MaxMetricsPerRecord < 0 {
+		return fmt.Errorf("invalid max_metrics_per_record %d, must not be negative", k.MaxMetricsPerRecord)
+	}
+
+	if k.BufferWALFile != "" && k.MinFlushBytes.Size <= 0 {
+		return fmt.Errorf("buffer_wal_file requires min_flush_bytes to be set")
+	}
+
+	switch k.AsyncFullBehavior {
+	case "":
+		k.AsyncFullBehavior = "drop"
+	case "drop", "block":
+	default:
+		return fmt.Errorf("invalid async_full_behavior %q", k.AsyncFullBehavior)
+	}
+
+	if k.Async {
+		switch {
+		case k.MinFlushBytes.Size > 0:
+			return fmt.Errorf("async can not be combined with min_flush_bytes")
+		case k.RetryOnThrottle:
+			return fmt.Errorf("async can not be combined with retry_on_throttle")
+		case k.CircuitBreakerThreshold > 0:
+			return fmt.Errorf("async can not be combined with circuit_breaker_threshold")
+		case k.ReturnErrorsOnDrop:
+			return fmt.Errorf("async can not be combined with return_errors_on_drop")
+		case k.Strict:
+			return fmt.Errorf("async can not be combined with strict")
+		}
+	}
+
+	tags := map[string]string{
+		"stream": strings.Join(k.streamNames(), ","),
+	}
+	k.serializeErrors = selfstat.Register("kinesis", "serialize_errors", tags)
+	k.staleMetricsDropped = selfstat.Register("kinesis", "stale_metrics_dropped", tags)
+	k.bytesWritten = selfstat.Register("kinesis", "bytes_written", tags)
+	k.recordsFailed = selfstat.Register("kinesis", "records_failed", tags)
+	k.uuidErrors = selfstat.Register("kinesis", "uuid_errors", tags)
+	k.asyncDropped = selfstat.Register("kinesis", "async_dropped", tags)
+	k.walDropped = selfstat.Register("kinesis", "wal_dropped", tags)
+	k.shardFanout = selfstat.Register("kinesis", "shard_fanout", tags)
+	k.metricsPacked = selfstat.Register("kinesis", "metrics_packed", tags)
+	k.recordsProduced = selfstat.Register("kinesis", "records_produced", tags)
+	k.registerLifecycleEvents(tags)
+
+	if k.CircuitBreakerThreshold > 0 {
+		cooldown := k.CircuitBreakerCooldown.Duration
+		if cooldown == 0 {
+			cooldown = time.Minute
+		}
+		k.breaker = &circuitBreaker{
+			threshold: k.CircuitBreakerThreshold,
+			cooldown:  cooldown,
+		}
+	}
+
+	if k.LogSuppressionWindow.Duration > 0 {
+		k.logLimiter = newLogLimiter(k.LogSuppressionWindow.Duration)
+	}
+
+	if k.connectRetryDelay == 0 {
+		k.connectRetryDelay = time.Second
+	}
+
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
 func (k *KinesisOutput) Connect() error {
+	stream := strings.Join(k.streamNames(), ",")
+	if err := k.connect(); err != nil {
+		k.emitEvent(eventConnectFailed, stream, "", err)
+		return err
+	}
+	k.emitEvent(eventConnected, stream, k.getStreamStatus(), nil)
+	return nil
+}
+
+func (k *KinesisOutput) connect() error {
 	if k.Partition == nil {
 		k.Log.Error("Deprecated partitionkey configuration in use, please consider using outputs.kinesis.partition")
 	}
 
+	svc := k.injectedSvc
+	if svc == nil {
+		var c *client.Client
+		svc, c = k.newService()
+		k.endpoint = c.Endpoint
+		k.credentials = c.Config.Credentials
+	}
+
+	if k.ConnectJitter.Duration > 0 {
+		jitter := internal.RandomDuration(k.ConnectJitter.Duration)
+		k.Log.Debugf("Sleeping %s before validating stream", jitter)
+		if err := internal.SleepContext(k.ctx, jitter); err != nil {
+			return err
+		}
+	}
+
+	k.svc = svc
+	if err := k.validateStream(); err != nil {
+		return err
+	}
+
+	if k.FallbackFile != "" {
+		if err := k.openFallback(); err != nil {
+			return fmt.Errorf("unable to open fallback file %q: %v", k.FallbackFile, err)
+		}
+	}
+
+	if k.BufferWALFile != "" && k.wal == nil {
+		if err := k.openWAL(); err != nil {
+			return err
+		}
+	}
+
+	if k.Async {
+		k.startAsync()
+	}
+
+	if k.StreamCheckInterval.Duration > 0 {
+		k.wg.Add(1)
+		go func() {
+			defer k.wg.Done()
+			k.checkStream(k.StreamCheckInterval.Duration)
+		}()
+	}
+
+	if k.HeartbeatInterval.Duration > 0 {
+		ticker := time.NewTicker(k.HeartbeatInterval.Duration)
+		k.wg.Add(1)
+		go func() {
+			defer k.wg.Done()
+			defer ticker.Stop()
+			k.heartbeatPeriodically(ticker.C)
+		}()
+	}
+
+	if k.MinFlushBytes.Size > 0 && k.BufferFlushInterval.Duration > 0 {
+		ticker := time.NewTicker(k.BufferFlushInterval.Duration)
+		k.wg.Add(1)
+		go func() {
+			defer k.wg.Done()
+			defer ticker.Stop()
+			k.flushBufferPeriodically(ticker.C)
+		}()
+	}
+
+	return nil
+}
+
+// newService creates the client for the configured backend.
+func (k *KinesisOutput) newService() (kinesisiface.KinesisAPI, *client.Client) {
 	// We attempt first to create a session to Kinesis using an IAMS role, if that fails it will fall through to using
 	// environment variables, and then Shared Credentials.
 	if k.Debug {
 		k.Log.Infof("Establishing a connection to Kinesis in %s", k.Region)
 	}
 
+	endpointURL, source := k.resolveEndpointURL()
+	if endpointURL != "" {
+		k.Log.Debugf("Using endpoint %s from %s", endpointURL, source)
+	}
+
 	credentialConfig := &internalaws.CredentialConfig{
 		Region:      k.Region,
 		AccessKey:   k.AccessKey,
@@ -138,106 +857,1044 @@ func (k *KinesisOutput) Connect() error {
 		Profile:     k.Profile,
 		Filename:    k.Filename,
 		Token:       k.Token,
-		EndpointURL: k.EndpointURL,
+		EndpointURL: endpointURL,
 	}
 	configProvider := credentialConfig.Credentials()
-	svc := kinesis.New(configProvider)
 
-	_, err := svc.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
-		StreamName: aws.String(k.StreamName),
-	})
-	k.svc = svc
-	return err
+	var svc kinesisiface.KinesisAPI
+	var c *client.Client
+	if k.Backend == "firehose" {
+		fh := firehose.New(configProvider, k.clientConfig())
+		svc, c = &firehoseClient{svc: fh}, fh.Client
+	} else {
+		ks := kinesis.New(configProvider, k.clientConfig())
+		svc, c = ks, ks.Client
+	}
+	c.Handlers.Build.PushBackNamed(k.userAgentHandler())
+	k.applySigningOverrides(c)
+	return svc, c
 }
 
 func (k *KinesisOutput) Close() error {
-	return nil
-}
-
-func (k *KinesisOutput) SetSerializer(serializer serializers.Serializer) {
-	k.serializer = serializer
-}
+	if k.cancel != nil {
+		k.cancel()
+	}
+	k.wg.Wait()
+	k.stopAsync()
 
-func (k *KinesisOutput) writeKinesis(r []*kinesis.PutRecordsRequestEntry) time.Duration {
+	k.bufferLock.Lock()
+	r, _, position := k.takeBuffer()
+	k.bufferLock.Unlock()
 
-	start := time.Now()
-	payload := &kinesis.PutRecordsInput{
-		Records:    r,
-		StreamName: aws.String(k.StreamName),
+	if len(r) > 0 && k.svc != nil {
+		result := k.sendBatches(r)
+		if len(result.errored) == 0 {
+			k.discardWAL(position)
+		} else if k.wal != nil {
+			k.Log.Warnf("Keeping %d unsent record(s) in write-ahead log %q to replay on the next start",
+				len(result.errored), k.BufferWALFile)
+		} else {
+			k.writeFallback(result.errored)
+		}
 	}
 
-	resp, err := k.svc.PutRecords(payload)
-	if err != nil {
-		k.Log.Errorf("Unable to write to Kinesis : %s", err.Error())
-		return time.Since(start)
+	err := k.closeFallback()
+	if k.wal != nil {
+		if walErr := k.wal.close(); walErr != nil {
+			err = walErr
+		}
+		k.wal = nil
 	}
+	return err
+}
 
-	if k.Debug {
-		k.Log.Infof("Wrote: '%+v'", resp)
+// openWAL opens the write-ahead log and buffers any records left in it.
+func (k *KinesisOutput) openWAL() error {
+	maxSize := k.BufferWALMaxSize.Size
+	if maxSize <= 0 {
+		maxSize = defaultWALMaxSize
 	}
 
-	failed := *resp.FailedRecordCount
-	if failed > 0 {
-		k.Log.Errorf("Unable to write %+v of %+v record(s) to Kinesis", failed, len(r))
+	wal, records, corrupted, err := openWriteAheadLog(k.BufferWALFile, maxSize)
+	if err != nil {
+		return fmt.Errorf("unable to open write-ahead log %q: %v", k.BufferWALFile, err)
+	}
+	if corrupted > 0 {
+		k.Log.Warnf("Removed %d corrupted byte(s) from the end of write-ahead log %q", corrupted, k.BufferWALFile)
 	}
+	if len(records) > 0 {
+		k.Log.Infof("Replaying %d record(s) from write-ahead log %q", len(records), k.BufferWALFile)
+	}
+
+	// the log does not keep the number of metrics packed into each record,
+	// so replayed records count as one metric each
+	k.bufferLock.Lock()
+	k.bufferRecords(records, singleCounts(len(records)))
+	k.bufferLock.Unlock()
 
-	return time.Since(start)
+	k.wal = wal
+	return nil
 }
 
-func (k *KinesisOutput) getPartitionKey(metric telegraf.Metric) string {
-	if k.Partition != nil {
-		switch k.Partition.Method {
-		case "static":
-			return k.Partition.Key
-		case "random":
-			u, err := uuid.NewV4()
-			if err != nil {
-				return k.Partition.Default
-			}
-			return u.String()
-		case "measurement":
-			return metric.Name()
-		case "tag":
-			if t, ok := metric.GetTag(k.Partition.Key); ok {
-				return t
-			} else if len(k.Partition.Default) > 0 {
-				return k.Partition.Default
-			}
-			// Default partition name if default is not set
-			return "telegraf"
-		default:
-			k.Log.Errorf("You have configured a Partition method of '%s' which is not supported", k.Partition.Method)
-		}
+// settleWAL removes the records up to position from the write-ahead log once
+// they have been sent. When a request failed outright its records are kept
+// in the log and put back in the buffer to be retried instead, unless the
+// buffer would grow beyond buffer_wal_max_size. Records that are not kept are
+// written to the fallback file. counts holds the number of metrics in each of
+// the records sent.
+func (k *KinesisOutput) settleWAL(result writeResult, r []*kinesis.PutRecordsRequestEntry, counts []int, position int64) {
+	if k.wal == nil {
+		k.writeFallback(result.errored)
+		return
 	}
-	if k.RandomPartitionKey {
-		u, err := uuid.NewV4()
-		if err != nil {
-			return k.Partition.Default
-		}
-		return u.String()
+	if len(result.errored) == 0 {
+		k.discardWAL(position)
+		return
 	}
-	return k.PartitionKey
-}
 
-func (k *KinesisOutput) Write(metrics []telegraf.Metric) error {
-	var sz uint32
+	sent := make(map[*kinesis.PutRecordsRequestEntry]int, len(r))
+	for i, record := range r {
+		sent[record] = counts[i]
+	}
+	erroredCounts := make([]int, len(result.errored))
+	for i, record := range result.errored {
+		erroredCounts[i] = sent[record]
+	}
 
-	if len(metrics) == 0 {
-		return nil
+	var size int64
+	for _, record := range result.errored {
+		size += int64(len(record.Data) + len(aws.StringValue(record.PartitionKey)))
 	}
 
-	r := []*kinesis.PutRecordsRequestEntry{}
+	k.bufferLock.Lock()
+	if k.bufferBytes+size > k.wal.maxSize {
+		k.bufferLock.Unlock()
+		k.walDropped.Incr(int64(len(result.errored)))
+		k.Log.Errorf("Dropping %d unsent record(s), the buffer would grow beyond the %d bytes of buffer_wal_max_size",
+			len(result.errored), k.wal.maxSize)
+		k.writeFallback(result.errored)
+		return
+	}
 
-	for _, metric := range metrics {
-		sz++
+	k.Log.Warnf("Keeping %d unsent record(s) in write-ahead log %q to retry them", len(result.errored), k.BufferWALFile)
+	k.rebufferRecords(result.errored, erroredCounts)
+	k.bufferLock.Unlock()
+}
 
-		values, err := k.serializer.Serialize(metric)
-		if err != nil {
-			k.Log.Debugf("Could not serialize metric: %v", err)
-			continue
-		}
+// discardWAL removes records up to position from the write-ahead log once
+// they have been sent.
+func (k *KinesisOutput) discardWAL(position int64) {
+	if k.wal == nil {
+		return
+	}
+	if err := k.wal.discard(position); err != nil {
+		k.Log.Errorf("Unable to discard sent records from write-ahead log %q: %v", k.BufferWALFile, err)
+	}
+}
 
-		partitionKey := k.getPartitionKey(metric)
+// resolveEndpointURL returns the endpoint override and where it was found.
+// The endpoint_url option takes precedence over the service specific
+// environment variable, which takes precedence over the global one.
+func (k *KinesisOutput) resolveEndpointURL() (string, string) {
+	if k.EndpointURL != "" {
+		return k.EndpointURL, "endpoint_url"
+	}
+
+	serviceEnv := "AWS_ENDPOINT_URL_KINESIS"
+	if k.Backend == "firehose" {
+		serviceEnv = "AWS_ENDPOINT_URL_FIREHOSE"
+	}
+	for _, env := range []string{serviceEnv, "AWS_ENDPOINT_URL"} {
+		if endpointURL := os.Getenv(env); endpointURL != "" {
+			return endpointURL, env
+		}
+	}
+	return "", ""
+}
+
+// partitionResolver returns the endpoint resolver for the AWS partition,
+// checking that the region belongs to it.
+func partitionResolver(partitionID, region string) (endpoints.Resolver, error) {
+	for _, p := range endpoints.DefaultPartitions() {
+		if p.ID() != partitionID {
+			continue
+		}
+
+		if rp, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); !ok || rp.ID() != partitionID {
+			return nil, fmt.Errorf("region %q does not belong to partition %q", region, partitionID)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown partition_id %q", partitionID)
+}
+
+// clientConfig returns the configuration applied on top of the session when
+// creating the Kinesis or Firehose client.
+func (k *KinesisOutput) clientConfig() *aws.Config {
+	cfg := &aws.Config{
+		HTTPClient: &http.Client{Transport: k.transport()},
+	}
+	if k.resolver != nil {
+		cfg.EndpointResolver = k.resolver
+	}
+	return cfg
+}
+
+// transport returns the HTTP transport used by the client. Idle connections
+// are kept for every request that may be in flight to the single endpoint,
+// rather than the two per host kept by default, so steady streams reuse
+// connections instead of repeating TLS handshakes.
+func (k *KinesisOutput) transport() *http.Transport {
+	idleConnTimeout := k.IdleConnTimeout.Duration
+	if idleConnTimeout == 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+	maxIdleConns := k.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = 100
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.DialContext = k.dialer().DialContext
+	return transport
+}
+
+func (k *KinesisOutput) dialer() *net.Dialer {
+	keepAlive := k.KeepAlive.Duration
+	if keepAlive == 0 {
+		keepAlive = 30 * time.Second
+	}
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: keepAlive,
+	}
+}
+
+// applySigningOverrides replaces the signing name and region resolved for
+// the endpoint with the configured values.
+func (k *KinesisOutput) applySigningOverrides(svc *client.Client) {
+	if k.SigningName != "" {
+		svc.ClientInfo.SigningName = k.SigningName
+	}
+	if k.SigningRegion != "" {
+		svc.ClientInfo.SigningRegion = k.SigningRegion
+	}
+}
+
+// userAgentHandler appends the configured user agent to each request.
+func (k *KinesisOutput) userAgentHandler() request.NamedHandler {
+	userAgent := k.UserAgent
+	if userAgent == "" {
+		userAgent = internal.ProductToken() + " outputs.kinesis"
+	}
+
+	return request.NamedHandler{
+		Name: "telegraf.kinesis.UserAgentHandler",
+		Fn:   request.MakeAddToUserAgentFreeFormHandler(userAgent),
+	}
+}
+
+// validateStream checks that the streams exist when connecting, explaining
+// the most common causes of failure.
+func (k *KinesisOutput) validateStream() error {
+	for _, stream := range k.streamNames() {
+		if err := k.validateStreamName(stream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KinesisOutput) validateStreamName(stream string) error {
+	summary, err := k.describeStream(stream)
+
+	delay := k.connectRetryDelay
+	for retry := 0; err != nil && isTransientConnectError(err) && retry < k.ConnectMaxRetries; retry++ {
+		k.Log.Warnf("Unable to describe stream %q, retrying in %s: %v", stream, delay, err)
+		if err := internal.SleepContext(k.ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		summary, err = k.describeStream(stream)
+	}
+
+	if err == nil {
+		return k.checkEncryption(stream, summary)
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case kinesis.ErrCodeResourceNotFoundException:
+			return fmt.Errorf("stream %q was not found in region %s, it must be created before starting telegraf: %v",
+				stream, k.Region, err)
+		case "AccessDeniedException":
+			permissions := "kinesis:DescribeStreamSummary and kinesis:PutRecords"
+			if k.Backend == "firehose" {
+				permissions = "firehose:DescribeDeliveryStream and firehose:PutRecordBatch"
+			}
+			return fmt.Errorf("access denied describing stream %q, the credentials must allow %s: %v",
+				stream, permissions, err)
+		}
+	}
+	return err
+}
+
+// isTransientConnectError reports whether describing the stream may succeed
+// if retried. A missing stream or denied access will not resolve itself.
+func isTransientConnectError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case kinesis.ErrCodeResourceNotFoundException, "AccessDeniedException":
+			return false
+		}
+	}
+	return true
+}
+
+// checkEncryption logs the encryption type of the stream and fails when
+// encryption is required but the stream is not encrypted.
+func (k *KinesisOutput) checkEncryption(stream string, summary *kinesis.StreamDescriptionSummary) error {
+	encryptionType := kinesis.EncryptionTypeNone
+	if summary != nil && summary.EncryptionType != nil {
+		encryptionType = *summary.EncryptionType
+	}
+	k.Log.Infof("Stream %q encryption type is %s", stream, encryptionType)
+
+	if k.EncryptionRequired && encryptionType == kinesis.EncryptionTypeNone {
+		return fmt.Errorf("stream %q is not encrypted at rest and encryption_required is set", stream)
+	}
+	return nil
+}
+
+// describeStream fetches the stream summary and records the stream status.
+func (k *KinesisOutput) describeStream(stream string) (*kinesis.StreamDescriptionSummary, error) {
+	resp, err := k.svc.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := resp.StreamDescriptionSummary
+	if summary != nil {
+		k.setStreamStatus(stream, aws.StringValue(summary.StreamStatus))
+	}
+	return summary, nil
+}
+
+// checkStream periodically re-validates the stream until the plugin is closed.
+func (k *KinesisOutput) checkStream(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, stream := range k.streamNames() {
+				if _, err := k.describeStream(stream); err != nil {
+					k.Log.Warnf("Unable to check status of stream %q: %v", stream, err)
+				}
+			}
+		}
+	}
+}
+
+func (k *KinesisOutput) setStreamStatus(stream, status string) {
+	k.statusLock.Lock()
+	defer k.statusLock.Unlock()
+
+	if k.streamStatus == nil {
+		k.streamStatus = map[string]string{}
+	}
+	previous := k.streamStatus[stream]
+	k.streamStatus[stream] = status
+	if previous == status {
+		return
+	}
+
+	if status != kinesis.StreamStatusActive {
+		k.emitEvent(eventStreamInactive, stream, status, nil)
+	} else if previous != "" {
+		k.emitEvent(eventStreamActive, stream, status, nil)
+	}
+	if previous == "" {
+		return
+	}
+
+	if status == kinesis.StreamStatusActive {
+		k.Log.Infof("Stream %q status changed from %s to %s", stream, previous, status)
+	} else {
+		k.Log.Warnf("Stream %q status changed from %s to %s", stream, previous, status)
+	}
+}
+
+// getStreamStatus returns the status of the first stream.
+func (k *KinesisOutput) getStreamStatus() string {
+	k.statusLock.Lock()
+	defer k.statusLock.Unlock()
+	return k.streamStatus[k.streamNames()[0]]
+}
+
+func (k *KinesisOutput) SetSerializer(serializer serializers.Serializer) {
+	k.serializer = serializer
+}
+
+// writeResult summarizes the outcome of a single PutRecords call.
+type writeResult struct {
+	records    int
+	failed     int
+	throttled  int
+	timedOut   int
+	mismatched int
+	requests   int
+	retries    int
+	bytes      int64
+	elapsed    time.Duration
+
+	// errored holds the records of requests that failed outright or whose
+	// response did not hold a result for every record, which are retried as
+	// a whole.
+	errored []*kinesis.PutRecordsRequestEntry
+}
+
+func (w *writeResult) add(other writeResult) {
+	w.records += other.records
+	w.failed += other.failed
+	w.throttled += other.throttled
+	w.timedOut += other.timedOut
+	w.mismatched += other.mismatched
+	w.requests += other.requests
+	w.retries += other.retries
+	w.bytes += other.bytes
+	w.elapsed += other.elapsed
+	w.errored = append(w.errored, other.errored...)
+}
+
+func (k *KinesisOutput) writeKinesis(stream string, r []*kinesis.PutRecordsRequestEntry) writeResult {
+
+	start := time.Now()
+	result := writeResult{records: len(r), failed: len(r), requests: 1}
+	payload := &kinesis.PutRecordsInput{
+		Records:    r,
+		StreamName: aws.String(stream),
+	}
+
+	resp, err := k.putRecords(payload)
+	if err != nil && isExpiredTokenError(err) && k.refreshCredentials() {
+		result.requests++
+		result.retries++
+		resp, err = k.putRecords(payload)
+	}
+	if err != nil {
+		k.logWriteError("Unable to write to Kinesis : %s", err.Error())
+		if isThrottlingError(err) {
+			result.throttled = len(r)
+		}
+		if _, ok := err.(*timeoutError); ok {
+			result.timedOut = len(r)
+		}
+		result.errored = r
+		result.elapsed = time.Since(start)
+		return result
+	}
+
+	if k.Debug {
+		k.Log.Infof("Wrote: '%+v'", resp)
+	}
+
+	if len(resp.Records) != len(r) {
+		k.logWriteError("Unable to write %+v record(s) to Kinesis : response contained %+v result(s)", len(r), len(resp.Records))
+		k.recordsFailed.Incr(int64(len(r)))
+		result.mismatched = len(r)
+		result.errored = r
+		result.elapsed = time.Since(start)
+		return result
+	}
+
+	failed := aws.Int64Value(resp.FailedRecordCount)
+	if failed > 0 {
+		k.recordsFailed.Incr(failed)
+		k.logPartialFailure(int(failed), len(r))
+	}
+	result.failed = int(failed)
+
+	var written int64
+	var unsent []*kinesis.PutRecordsRequestEntry
+	var throttledKeys []string
+	shards := map[string]bool{}
+	for i, entry := range resp.Records {
+		switch aws.StringValue(entry.ErrorCode) {
+		case "":
+			written += int64(k.recordSize(r[i]))
+			if entry.ShardId != nil {
+				shards[*entry.ShardId] = true
+			}
+			continue
+		case kinesis.ErrCodeProvisionedThroughputExceededException, firehose.ErrCodeServiceUnavailableException:
+			result.throttled++
+			if k.ReshuffleFailedOnRetry {
+				throttledKeys = append(throttledKeys, aws.StringValue(r[i].PartitionKey))
+			}
+		}
+		unsent = append(unsent, r[i])
+	}
+	k.addThrottledKeys(throttledKeys)
+	k.bytesWritten.Incr(written)
+	k.writeFallback(unsent)
+	result.bytes = written
+
+	// Firehose does not report shards
+	if len(shards) > 0 {
+		k.shardFanout.Set(int64(len(shards)))
+	}
+
+	if k.LogSequenceNumbers {
+		k.logSequenceNumbers(r, resp.Records)
+	}
+
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// addThrottledKeys records partition keys throttled by Kinesis, to be
+// reshuffled in the next write.
+func (k *KinesisOutput) addThrottledKeys(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	k.hotKeysLock.Lock()
+	defer k.hotKeysLock.Unlock()
+	if k.throttledKeys == nil {
+		k.throttledKeys = map[string]bool{}
+	}
+	for _, key := range keys {
+		k.throttledKeys[key] = true
+	}
+}
+
+// rotateHotKeys makes the keys throttled in the previous write the ones to
+// reshuffle in this write. Keys that are not throttled again are used as
+// configured in the following write.
+func (k *KinesisOutput) rotateHotKeys() {
+	k.hotKeysLock.Lock()
+	defer k.hotKeysLock.Unlock()
+	k.hotKeys = k.throttledKeys
+	k.throttledKeys = nil
+
+	if len(k.hotKeys) > 0 {
+		k.Log.Warnf("Using random partition keys for metrics with %d partition key(s) throttled in the previous write",
+			len(k.hotKeys))
+	}
+}
+
+// logPartialFailure logs records rejected by Kinesis in a successful request,
+// unless their fraction is within partial_failure_log_threshold.
+func (k *KinesisOutput) logPartialFailure(failed, records int) {
+	if k.PartialFailureLogThreshold <= 0 {
+		k.logWriteError("Unable to write %+v of %+v record(s) to Kinesis", failed, records)
+		return
+	}
+
+	if float64(failed)/float64(records) > k.PartialFailureLogThreshold {
+		k.logLimited(k.Log.Warnf, "Unable to write %+v of %+v record(s) to Kinesis, more than the partial failure threshold of %g",
+			failed, records, k.PartialFailureLogThreshold)
+	}
+}
+
+// logWriteError logs a failed write. When log_suppression_window is set,
+// messages repeated within the window are collapsed.
+func (k *KinesisOutput) logWriteError(format string, args ...interface{}) {
+	k.logLimited(k.Log.Errorf, format, args...)
+}
+
+// logLimited logs the message with logf, subject to log_suppression_window.
+func (k *KinesisOutput) logLimited(logf func(string, ...interface{}), format string, args ...interface{}) {
+	if k.logLimiter != nil {
+		ok, suppressed := k.logLimiter.allow(format, time.Now())
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			format += " (%d similar message(s) suppressed)"
+			args = append(args, suppressed)
+		}
+	}
+	logf(format, args...)
+}
+
+// putRecords issues a single PutRecords call, bounded by put_records_timeout.
+func (k *KinesisOutput) putRecords(payload *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	ctx := context.Background()
+	if k.PutRecordsTimeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.PutRecordsTimeout.Duration)
+		defer cancel()
+	}
+
+	resp, err := k.svc.PutRecordsWithContext(ctx, payload)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = &timeoutError{timeout: k.PutRecordsTimeout.Duration}
+	}
+	return resp, err
+}
+
+// timeoutError is returned for a PutRecords call abandoned after
+// put_records_timeout. Its records may be retried like throttled ones.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.timeout)
+}
+
+func isThrottlingError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case kinesis.ErrCodeProvisionedThroughputExceededException, kinesis.ErrCodeLimitExceededException,
+			"ThrottlingException", firehose.ErrCodeServiceUnavailableException:
+			return true
+		}
+	}
+	return false
+}
+
+func isExpiredTokenError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "ExpiredToken", "ExpiredTokenException":
+			return true
+		}
+	}
+	return false
+}
+
+// refreshCredentials expires the cached credentials and retrieves new ones
+// from the provider. It reports whether the refresh succeeded.
+func (k *KinesisOutput) refreshCredentials() bool {
+	if k.credentials == nil {
+		return false
+	}
+
+	k.Log.Warn("Kinesis credentials have expired, refreshing")
+	k.credentials.Expire()
+	if _, err := k.credentials.Get(); err != nil {
+		k.Log.Errorf("Unable to refresh Kinesis credentials: %v", err)
+		return false
+	}
+	return true
+}
+
+func (k *KinesisOutput) logSequenceNumbers(
+	r []*kinesis.PutRecordsRequestEntry,
+	results []*kinesis.PutRecordsResultEntry,
+) {
+	for i, result := range results {
+		if result.ErrorCode != nil {
+			continue
+		}
+
+		k.Log.Debugf(
+			"Wrote record with partition key %q to shard %s at sequence number %s",
+			aws.StringValue(r[i].PartitionKey),
+			aws.StringValue(result.ShardId),
+			aws.StringValue(result.SequenceNumber),
+		)
+	}
+}
+
+func (k *KinesisOutput) getPartitionKey(metric telegraf.Metric) string {
+	var key string
+	if k.partitionTemplate != nil {
+		key = k.templatePartitionKey(metric)
+	} else {
+		key = k.basePartitionKey(metric)
+	}
+	return k.prefixPartitionKey(key)
+}
+
+// prefixPartitionKey prepends partition_key_prefix to the key, truncated to
+// the Kinesis partition key limit.
+func (k *KinesisOutput) prefixPartitionKey(key string) string {
+	if k.PartitionKeyPrefix == "" {
+		return key
+	}
+	return truncatePartitionKey(k.PartitionKeyPrefix + key)
+}
+
+// truncatePartitionKey shortens the key to the Kinesis partition key limit
+// without splitting a multi-byte character.
+func truncatePartitionKey(key string) string {
+	if len(key) <= maxPartitionKeyLength {
+		return key
+	}
+
+	end := maxPartitionKeyLength
+	for end > 0 && !utf8.RuneStart(key[end]) {
+		end--
+	}
+	return key[:end]
+}
+
+func (k *KinesisOutput) basePartitionKey(metric telegraf.Metric) string {
+	if k.Partition != nil {
+		switch k.Partition.Method {
+		case "static":
+			return k.Partition.Key
+		case "random":
+			return k.randomPartitionKey()
+		case "measurement":
+			return metric.Name()
+		case "tag":
+			if len(k.Partition.Keys) > 0 {
+				return k.multiTagPartitionKey(metric)
+			}
+			if t, ok := metric.GetTag(k.Partition.Key); ok {
+				return t
+			} else if len(k.Partition.Default) > 0 {
+				return k.Partition.Default
+			}
+			// Default partition name if default is not set
+			return "telegraf"
+		case "measurement_tag":
+			if t, ok := metric.GetTag(k.Partition.Key); ok {
+				return metric.Name() + "/" + t
+			} else if len(k.Partition.Default) > 0 {
+				return k.Partition.Default
+			}
+			return "telegraf"
+		default:
+			k.Log.Errorf("You have configured a Partition method of '%s' which is not supported", k.Partition.Method)
+		}
+	}
+	if k.RandomPartitionKey {
+		return k.randomPartitionKey()
+	}
+	return k.PartitionKey
+}
+
+// multiTagPartitionKey joins the values of the tags listed in the partition
+// keys with the separator. When a tag is missing the default is used, or
+// with missing_tags set to "empty" the tag value is left empty.
+func (k *KinesisOutput) multiTagPartitionKey(metric telegraf.Metric) string {
+	values := make([]string, 0, len(k.Partition.Keys))
+	for _, key := range k.Partition.Keys {
+		t, ok := metric.GetTag(key)
+		if !ok && k.Partition.MissingTags != "empty" {
+			values = nil
+			break
+		}
+		values = append(values, t)
+	}
+
+	if key := strings.Join(values, k.Partition.Separator); key != "" {
+		return key
+	}
+	if len(k.Partition.Default) > 0 {
+		return k.Partition.Default
+	}
+	return "telegraf"
+}
+
+// randomPartitionKey returns a random UUID. If one cannot be generated, a key
+// made of the current time and a counter is used instead, so records remain
+// spread across shards.
+func (k *KinesisOutput) randomPartitionKey() string {
+	newUUID := k.newUUID
+	if newUUID == nil {
+		newUUID = uuid.NewV4
+	}
+
+	u, err := newUUID()
+	if err == nil {
+		return u.String()
+	}
+
+	k.uuidErrors.Incr(1)
+	k.Log.Warnf("Unable to generate random partition key, using a time based key: %v", err)
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint32(&k.fallbackKeys, 1))
+}
+
+func (k *KinesisOutput) Write(metrics []telegraf.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	if k.breaker != nil {
+		if err := k.breaker.allow(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if k.ReshuffleFailedOnRetry {
+		k.rotateHotKeys()
+	}
+
+	chunkSize := len(metrics)
+	if k.MaxMetricsPerWrite > 0 && k.MaxMetricsPerWrite < chunkSize {
+		chunkSize = k.MaxMetricsPerWrite
+	}
+
+	// Each chunk is normally sent before the next one is serialized, bounding
+	// the memory used by the write. In strict mode nothing is sent when a
+	// metric was dropped, so that retrying the write does not send the other
+	// records twice, and every chunk must be serialized first. Async writes
+	// are queued as a whole.
+	collect := k.Strict || k.Async
+
+	start := time.Now()
+	var result writeResult
+	produced, dropped, stale, empty := 0, 0, 0, 0
+	var chunks [][]*kinesis.PutRecordsRequestEntry
+	var chunkCounts [][]int
+	for first := 0; first < len(metrics); first += chunkSize {
+		last := first + chunkSize
+		if last > len(metrics) {
+			last = len(metrics)
+		}
+
+		r, c, n, s, e, err := k.chunkRecords(metrics[first:last])
+		if err != nil {
+			return err
+		}
+		produced += len(r)
+		dropped += n
+		stale += s
+		empty += e
+
+		if collect {
+			chunks = append(chunks, r)
+			chunkCounts = append(chunkCounts, c)
+			continue
+		}
+		result.add(k.sendRecords(r, c))
+	}
+
+	if produced > 0 {
+		k.metricsPacked.Incr(int64(len(metrics) - dropped))
+		k.recordsProduced.Incr(int64(produced))
+	}
+
+	// Stale metrics and metrics with empty serialized output are skipped
+	// rather than dropped, as retrying the write would not send them either.
+	if k.Strict && dropped > stale+empty {
+		return fmt.Errorf("dropped %d of %d metric(s), not writing to Kinesis in strict mode",
+			dropped-stale-empty, len(metrics))
+	}
+
+	if k.Async {
+		var r []*kinesis.PutRecordsRequestEntry
+		for _, chunk := range chunks {
+			r = append(r, chunk...)
+		}
+		k.enqueue(r)
+		return nil
+	}
+
+	for i, r := range chunks {
+		result.add(k.sendRecords(r, chunkCounts[i]))
+	}
+
+	if k.breaker != nil && result.records > 0 {
+		previous := k.breaker.state
+		state := k.breaker.record(result.failed < result.records, time.Now())
+		if state != previous {
+			k.Log.Warnf("Circuit breaker changed from %s to %s", previous, state)
+		}
+	}
+
+	if k.LogFlushSummary {
+		k.Log.Infof("Flushed %d metric(s) as %d record(s): sent %d record(s) in %d request(s) with %d failed and %d retried, %d byte(s) in %s",
+			len(metrics), produced, result.records, result.requests, result.failed, result.retries, result.bytes, time.Since(start))
+	}
+
+	if k.RetryOnThrottle && result.timedOut > 0 {
+		return fmt.Errorf("%d of %d record(s) were throttled by Kinesis and %d timed out, retrying on the next flush",
+			result.throttled, result.records, result.timedOut)
+	}
+	if k.RetryOnThrottle && result.mismatched > 0 {
+		return fmt.Errorf("%d of %d record(s) got a response from Kinesis without their result, retrying on the next flush",
+			result.mismatched, result.records)
+	}
+	if k.RetryOnThrottle && result.throttled > 0 {
+		return fmt.Errorf("%d of %d record(s) were throttled by Kinesis, retrying on the next flush",
+			result.throttled, result.records)
+	}
+
+	if k.Strict && result.failed > 0 {
+		return fmt.Errorf("failed to write %d of %d record(s) in strict mode", result.failed, result.records)
+	}
+
+	if k.ReturnErrorsOnDrop && (result.failed > 0 || dropped > stale+empty) {
+		return fmt.Errorf("failed to write %d of %d record(s) and dropped %d of %d metric(s)",
+			result.failed, result.records, dropped-stale-empty, len(metrics))
+	}
+	return nil
+}
+
+// chunkRecords serializes and encodes a chunk of a write, returning the
+// records, the number of metrics in each, the number of metrics dropped and
+// how many of those were stale or had empty serialized output.
+func (k *KinesisOutput) chunkRecords(metrics []telegraf.Metric) ([]*kinesis.PutRecordsRequestEntry, []int, int, int, int, error) {
+	var r []*kinesis.PutRecordsRequestEntry
+	var counts []int
+	dropped, stale, empty := 0, 0, 0
+	for _, bucket := range k.timeBuckets(metrics) {
+		created, s, e, err := k.createRecords(bucket)
+		if err != nil {
+			return nil, nil, 0, 0, 0, err
+		}
+		dropped += len(bucket) - len(created)
+		stale += s
+		empty += e
+
+		created, c, n := k.encodeRecords(created)
+		dropped += n
+		r = append(r, created...)
+		counts = append(counts, c...)
+	}
+	return r, counts, dropped, stale, empty, nil
+}
+
+// sendRecords writes the records of a chunk, through the buffer when
+// min_flush_bytes is set. counts holds the number of metrics in each record.
+func (k *KinesisOutput) sendRecords(r []*kinesis.PutRecordsRequestEntry, counts []int) writeResult {
+	if k.MinFlushBytes.Size <= 0 {
+		return k.writeRecords(r)
+	}
+
+	r, counts, position := k.bufferAndTake(r, counts)
+	result := k.sendBatches(r)
+	k.settleWAL(result, r, counts, position)
+	return result
+}
+
+func (k *KinesisOutput) serialize(metric telegraf.Metric) ([]byte, error) {
+	k.serializerLock.Lock()
+	defer k.serializerLock.Unlock()
+	return k.serializer.Serialize(metric)
+}
+
+// transformMetric renames the measurement and rounds the timestamp of the
+// metric before it is serialized and its partition key computed. The metric
+// is copied when changed as it belongs to the agent buffer.
+func (k *KinesisOutput) transformMetric(metric telegraf.Metric) telegraf.Metric {
+	name, rename := k.MeasurementRename[metric.Name()]
+	if !rename && k.TimestampPrecision.Duration <= 0 {
+		return metric
+	}
+
+	metric = metric.Copy()
+	if rename {
+		metric.SetName(name)
+	}
+	if k.TimestampPrecision.Duration > 0 {
+		metric.SetTime(metric.Time().Round(k.TimestampPrecision.Duration))
+	}
+	return metric
+}
+
+// minSerializedSize returns a lower bound for the size of the serialized
+// metric, from the length of its name, tags and field keys, and of its string
+// fields when withStrings is set. Most serializers write each of them at
+// least once, and numbers take at least a byte; see boundedSerializer for
+// the exceptions.
+func minSerializedSize(metric telegraf.Metric, withStrings bool) int {
+	size := len(metric.Name())
+	for _, tag := range metric.TagList() {
+		size += len(tag.Key) + len(tag.Value)
+	}
+	for _, field := range metric.FieldList() {
+		if s, ok := field.Value.(string); ok {
+			if withStrings {
+				size += len(field.Key) + len(s)
+			}
+			continue
+		}
+		size += len(field.Key) + 1
+	}
+	return size
+}
+
+// writesStringFields reports whether the serializer is known to write string
+// fields. Others, such as prometheus, wavefront or splunkmetric, leave them
+// out, so string fields only count towards minSerializedSize for these.
+func writesStringFields(serializer serializers.Serializer) bool {
+	switch serializer.(type) {
+	case *influx.Serializer, *msgpack.Serializer:
+		return true
+	}
+	return false
+}
+
+// boundedSerializer reports whether minSerializedSize is a lower bound for
+// the output of the serializer. Graphite templates leave out tag keys and
+// prometheusremotewrite compresses its output with snappy, so metrics may be
+// smaller than the bound in either format.
+func boundedSerializer(serializer serializers.Serializer) bool {
+	switch serializer.(type) {
+	case *graphite.GraphiteSerializer, *prometheusremotewrite.Serializer:
+		return false
+	}
+	return true
+}
+
+// createRecords serializes the metrics into records, returning the number of
+// metrics dropped for being older than max_metric_age and the number skipped
+// for having empty serialized output.
+func (k *KinesisOutput) createRecords(metrics []telegraf.Metric) ([]*kinesis.PutRecordsRequestEntry, int, int, error) {
+	r := []*kinesis.PutRecordsRequestEntry{}
+
+	var oldest time.Time
+	if k.MaxMetricAge.Duration > 0 {
+		oldest = time.Now().Add(-k.MaxMetricAge.Duration)
+	}
+
+	stale, empty := 0, 0
+	for _, metric := range metrics {
+		if !oldest.IsZero() && metric.Time().Before(oldest) {
+			k.staleMetricsDropped.Incr(1)
+			stale++
+			continue
+		}
+
+		if k.SkipOversizedMetrics && k.ContentEncoding == "identity" && boundedSerializer(k.serializer) {
+			size, limit := minSerializedSize(metric, writesStringFields(k.serializer)), k.recordDataLimit("")
+			if size > limit {
+				k.Log.Warnf("Dropping metric %q of at least %d bytes without serializing it, larger than the %d byte record limit",
+					metric.Name(), size, limit)
+				continue
+			}
+		}
+
+		metric = k.transformMetric(metric)
+
+		values, err := k.serialize(metric)
+		if err != nil {
+			k.serializeErrors.Incr(1)
+			if k.SerializeErrorBehavior == "error" {
+				return nil, 0, 0, fmt.Errorf("could not serialize metric: %v", err)
+			}
+			k.Log.Debugf("Could not serialize metric: %v", err)
+			continue
+		}
+
+		if len(values) == 0 {
+			k.Log.Debugf("Skipping metric %q with empty serialized output", metric.Name())
+			empty++
+			continue
+		}
+
+		partitionKey := k.getPartitionKey(metric)
+		if k.hotKeys[partitionKey] {
+			partitionKey = k.prefixPartitionKey(k.randomPartitionKey())
+		}
 
 		d := kinesis.PutRecordsRequestEntry{
 			Data:         values,
@@ -245,21 +1902,240 @@ func (k *KinesisOutput) Write(metrics []telegraf.Metric) error {
 		}
 
 		r = append(r, &d)
+	}
+
+	return r, stale, empty, nil
+}
 
-		if sz == maxRecordsPerRequest {
-			elapsed := k.writeKinesis(r)
-			k.Log.Debugf("Wrote a %d point batch to Kinesis in %+v.", sz, elapsed)
-			sz = 0
-			r = nil
+// encodeRecords applies the content encoding and then the record encoding to
+// the records, returning the encoded records, the number of records packed
+// into each and the number of records dropped while encoding.
+func (k *KinesisOutput) encodeRecords(r []*kinesis.PutRecordsRequestEntry) ([]*kinesis.PutRecordsRequestEntry, []int, int) {
+	counts := singleCounts(len(r))
+	dropped := 0
+	if k.ContentEncoding != "identity" {
+		r, counts, dropped = k.compressRecords(r)
+	}
+
+	if k.RecordEncoding == "base64" {
+		for _, record := range r {
+			data := make([]byte, base64.StdEncoding.EncodedLen(len(record.Data)))
+			base64.StdEncoding.Encode(data, record.Data)
+			record.Data = data
 		}
+	}
+	return r, counts, dropped
+}
 
+// singleCounts returns the metric counts of n records holding one metric
+// each.
+func singleCounts(n int) []int {
+	counts := make([]int, n)
+	for i := range counts {
+		counts[i] = 1
 	}
-	if sz > 0 {
-		elapsed := k.writeKinesis(r)
-		k.Log.Debugf("Wrote a %d point batch to Kinesis in %+v.", sz, elapsed)
+	return counts
+}
+
+// writeRecords sends the records in PutRecords requests and returns the
+// combined result. The records of failed requests are written to the
+// fallback file.
+func (k *KinesisOutput) writeRecords(r []*kinesis.PutRecordsRequestEntry) writeResult {
+	result := k.sendBatches(r)
+	k.writeFallback(result.errored)
+	return result
+}
+
+// sendBatches sends the records in PutRecords requests and returns the
+// combined result, leaving the records of failed requests to the caller, as
+// buffered records may be kept in the write-ahead log instead.
+func (k *KinesisOutput) sendBatches(r []*kinesis.PutRecordsRequestEntry) writeResult {
+	var total writeResult
+	if len(r) > 0 && k.HeartbeatInterval.Duration > 0 {
+		k.heartbeatLock.Lock()
+		k.recordsSent = true
+		k.heartbeatLock.Unlock()
 	}
 
-	return nil
+	for _, streamRecords := range k.assignStreams(r) {
+		for _, batch := range k.batchRecords(streamRecords.records) {
+			result := k.writeKinesis(streamRecords.stream, batch)
+			k.Log.Debugf("Wrote a %d point batch to Kinesis in %+v.", result.records, result.elapsed)
+			total.add(result)
+		}
+	}
+	return total
+}
+
+// batchRecords splits the records into requests of at most
+// maxRecordsPerRequest records, the request size limit of the backend and
+// max_partition_keys_per_request distinct partition keys.
+func (k *KinesisOutput) batchRecords(r []*kinesis.PutRecordsRequestEntry) [][]*kinesis.PutRecordsRequestEntry {
+	batches := [][]*kinesis.PutRecordsRequestEntry{}
+	keys := map[string]bool{}
+	requestLimit := k.requestSizeLimit()
+
+	start := 0
+	size := 0
+	for i, record := range r {
+		key := aws.StringValue(record.PartitionKey)
+		recordSize := k.recordSize(record)
+		full := i-start >= int(maxRecordsPerRequest)
+		if i > start && size+recordSize > requestLimit {
+			full = true
+		}
+		if k.MaxKeysPerRequest > 0 && !keys[key] && len(keys) >= k.MaxKeysPerRequest {
+			full = true
+		}
+
+		if full {
+			batches = append(batches, r[start:i])
+			start = i
+			size = 0
+			keys = map[string]bool{}
+		}
+		keys[key] = true
+		size += recordSize
+	}
+
+	if start < len(r) {
+		batches = append(batches, r[start:])
+	}
+	return batches
+}
+
+// recordSize returns the size of the record counted towards the limits of
+// the backend. Partition keys are not sent to Firehose.
+func (k *KinesisOutput) recordSize(record *kinesis.PutRecordsRequestEntry) int {
+	if k.Backend == "firehose" {
+		return len(record.Data)
+	}
+	return len(record.Data) + len(aws.StringValue(record.PartitionKey))
+}
+
+// recordDataLimit returns the maximum size of the data of a record with the
+// partition key, before the record encoding is applied. Base64 encodes every
+// 3 bytes as 4.
+func (k *KinesisOutput) recordDataLimit(key string) int {
+	limit := maxRecordSize - len(key)
+	if k.Backend == "firehose" {
+		limit = maxFirehoseRecordSize
+	}
+	if k.RecordEncoding == "base64" {
+		limit = limit / 4 * 3
+	}
+	return limit
+}
+
+func (k *KinesisOutput) requestSizeLimit() int {
+	if k.Backend == "firehose" {
+		return maxFirehoseRequestSize
+	}
+	return maxRequestSize
+}
+
+// bufferAndTake adds the records to the buffer and returns the buffered
+// records if the buffer is ready to be sent, along with the write-ahead log
+// position to discard once they have been sent. counts holds the number of
+// metrics in each record.
+func (k *KinesisOutput) bufferAndTake(r []*kinesis.PutRecordsRequestEntry, counts []int) ([]*kinesis.PutRecordsRequestEntry, []int, int64) {
+	k.bufferLock.Lock()
+	defer k.bufferLock.Unlock()
+
+	if k.wal != nil && len(r) > 0 {
+		if err := k.wal.append(r); err != nil {
+			k.Log.Warnf("Unable to persist %d record(s) to write-ahead log %q: %v", len(r), k.BufferWALFile, err)
+		}
+	}
+
+	k.bufferRecords(r, counts)
+	if !k.bufferReady() {
+		return nil, nil, 0
+	}
+	return k.takeBuffer()
+}
+
+// flushBufferPeriodically sends any buffered records on every tick until the
+// plugin is closed.
+func (k *KinesisOutput) flushBufferPeriodically(ticks <-chan time.Time) {
+	for {
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-ticks:
+			k.bufferLock.Lock()
+			r, counts, position := k.takeBuffer()
+			k.bufferLock.Unlock()
+
+			if len(r) > 0 {
+				k.Log.Debugf("Flushing %d buffered record(s)", len(r))
+				k.settleWAL(k.sendBatches(r), r, counts, position)
+			}
+		}
+	}
+}
+
+// bufferRecords adds the records to the buffer. counts holds the number of
+// metrics in each record, as compressed records hold many.
+func (k *KinesisOutput) bufferRecords(r []*kinesis.PutRecordsRequestEntry, counts []int) {
+	if len(r) == 0 {
+		return
+	}
+
+	if len(k.buffer) == 0 {
+		k.bufferStart = time.Now()
+	}
+
+	for i, record := range r {
+		k.bufferBytes += int64(len(record.Data) + len(aws.StringValue(record.PartitionKey)))
+		k.bufferMetrics += counts[i]
+	}
+	k.buffer = append(k.buffer, r...)
+	k.bufferCounts = append(k.bufferCounts, counts...)
+}
+
+// rebufferRecords puts records that failed to be sent back at the front of
+// the buffer, ahead of the records buffered since, as they come first in the
+// write-ahead log.
+func (k *KinesisOutput) rebufferRecords(r []*kinesis.PutRecordsRequestEntry, counts []int) {
+	buffered, bufferedCounts, _ := k.takeBuffer()
+	k.bufferRecords(r, counts)
+	k.bufferRecords(buffered, bufferedCounts)
+}
+
+// bufferReady reports whether the buffer has reached min_flush_bytes or
+// flush_metric_count, or has been held for longer than max_buffer_age.
+func (k *KinesisOutput) bufferReady() bool {
+	if len(k.buffer) == 0 {
+		return false
+	}
+
+	if k.bufferBytes >= k.MinFlushBytes.Size {
+		return true
+	}
+
+	if k.FlushMetricCount > 0 && k.bufferMetrics >= k.FlushMetricCount {
+		return true
+	}
+
+	return k.MaxBufferAge.Duration > 0 && time.Since(k.bufferStart) >= k.MaxBufferAge.Duration
+}
+
+// takeBuffer empties the buffer, returning the buffered records, the number
+// of metrics in each and the write-ahead log position that covers them.
+func (k *KinesisOutput) takeBuffer() ([]*kinesis.PutRecordsRequestEntry, []int, int64) {
+	var position int64
+	if k.wal != nil {
+		position = k.wal.position()
+	}
+
+	r, counts := k.buffer, k.bufferCounts
+	k.buffer = nil
+	k.bufferCounts = nil
+	k.bufferBytes = 0
+	k.bufferMetrics = 0
+	k.bufferStart = time.Time{}
+	return r, counts, position
 }
 
 func init() {
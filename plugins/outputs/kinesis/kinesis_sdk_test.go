@@ -0,0 +1,77 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/influxdata/telegraf/testutil/fakekinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeKinesisOutput(t *testing.T, server *fakekinesis.Server) *KinesisOutput {
+	k := &KinesisOutput{
+		Log:         testutil.Logger{},
+		Region:      "us-east-1",
+		AccessKey:   "access",
+		SecretKey:   "secret",
+		EndpointURL: server.URL,
+		StreamName:  "stream",
+		Partition: &Partition{
+			Method: "measurement",
+		},
+	}
+	k.SetSerializer(influx.NewSerializer())
+	require.NoError(t, k.Init())
+	return k
+}
+
+func TestFakeKinesis_Write(t *testing.T) {
+	server := fakekinesis.NewServer()
+	defer server.Close()
+	server.AddStream("stream", 4)
+
+	k := newFakeKinesisOutput(t, server)
+	require.NoError(t, k.Connect())
+	defer k.Close()
+	require.Equal(t, "ACTIVE", k.getStreamStatus())
+
+	metrics, metricsData := createTestMetrics(t, 3, influx.NewSerializer())
+	require.NoError(t, k.Write(metrics))
+
+	records := server.Records("stream")
+	require.Len(t, records, 3)
+	for i, record := range records {
+		require.Equal(t, metrics[i].Name(), record.PartitionKey)
+		require.Equal(t, metricsData[i], record.Data)
+		require.NotEmpty(t, record.ShardID)
+	}
+	require.Equal(t, []string{"DescribeStreamSummary", "PutRecords"}, server.Operations())
+}
+
+func TestFakeKinesis_SDKRetriesThrottling(t *testing.T) {
+	server := fakekinesis.NewServer()
+	defer server.Close()
+	server.AddStream("stream", 1)
+	server.FailNext("PutRecords", "ProvisionedThroughputExceededException", 400)
+
+	k := newFakeKinesisOutput(t, server)
+	require.NoError(t, k.Connect())
+	defer k.Close()
+
+	metrics, _ := createTestMetrics(t, 1, influx.NewSerializer())
+	require.NoError(t, k.Write(metrics))
+
+	require.Len(t, server.Records("stream"), 1)
+	require.Equal(t, []string{"DescribeStreamSummary", "PutRecords", "PutRecords"}, server.Operations())
+}
+
+func TestFakeKinesis_StreamNotFound(t *testing.T) {
+	server := fakekinesis.NewServer()
+	defer server.Close()
+
+	k := newFakeKinesisOutput(t, server)
+	err := k.Connect()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ResourceNotFoundException")
+}
@@ -1,17 +1,40 @@
 package kinesis
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/gofrs/uuid"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
 	"github.com/influxdata/telegraf/plugins/serializers"
+	"github.com/influxdata/telegraf/plugins/serializers/graphite"
 	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/plugins/serializers/prometheus"
+	"github.com/influxdata/telegraf/plugins/serializers/prometheusremotewrite"
 	"github.com/influxdata/telegraf/testutil"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -103,6 +126,751 @@ func TestPartitionKey(t *testing.T) {
 	assert.Equal(byte(4), u.Version(), "PartitionKey should be UUIDv4")
 }
 
+func TestPartitionKey_MeasurementTag(t *testing.T) {
+	testPoint := testutil.TestMetric(1)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "measurement_tag",
+			Key:    "tag1",
+		},
+	}
+	require.Equal(t, testPoint.Name()+"/"+testPoint.Tags()["tag1"], k.getPartitionKey(testPoint))
+
+	k = KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method:  "measurement_tag",
+			Key:     "doesnotexist",
+			Default: "somedefault",
+		},
+	}
+	require.Equal(t, "somedefault", k.getPartitionKey(testPoint))
+
+	k = KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "measurement_tag",
+			Key:    "doesnotexist",
+		},
+	}
+	require.Equal(t, "telegraf", k.getPartitionKey(testPoint))
+}
+
+func TestPartitionKey_Prefix(t *testing.T) {
+	testPoint := testutil.TestMetric(1)
+
+	partitions := []*Partition{
+		{Method: "static", Key: "-"},
+		{Method: "tag", Key: "tag1"},
+		{Method: "measurement"},
+		{Method: "random"},
+	}
+	for _, partition := range partitions {
+		k := KinesisOutput{
+			Log:                testutil.Logger{},
+			Partition:          partition,
+			PartitionKeyPrefix: "host1/",
+		}
+		key := k.getPartitionKey(testPoint)
+		require.True(t, strings.HasPrefix(key, "host1/"), "PartitionKey %q for method %s should be prefixed", key, partition.Method)
+	}
+
+	k := KinesisOutput{
+		Log:                testutil.Logger{},
+		PartitionKey:       strings.Repeat("k", maxPartitionKeyLength),
+		PartitionKeyPrefix: "host1/",
+	}
+	key := k.getPartitionKey(testPoint)
+	require.Equal(t, maxPartitionKeyLength, len(key))
+	require.True(t, strings.HasPrefix(key, "host1/"))
+
+	k = KinesisOutput{
+		Log:                testutil.Logger{},
+		PartitionKey:       strings.Repeat("é", maxPartitionKeyLength),
+		PartitionKeyPrefix: "h",
+	}
+	key = k.getPartitionKey(testPoint)
+	require.LessOrEqual(t, len(key), maxPartitionKeyLength)
+	require.True(t, utf8.ValidString(key), "PartitionKey should not split a character")
+}
+
+func TestPartitionKey_RandomUUIDFailure(t *testing.T) {
+	testPoint := testutil.TestMetric(1)
+
+	for _, k := range []*KinesisOutput{
+		{Partition: &Partition{Method: "random", Default: "default"}},
+		{RandomPartitionKey: true},
+	} {
+		k.Log = testutil.Logger{}
+		k.newUUID = func() (uuid.UUID, error) {
+			return uuid.Nil, errors.New("entropy exhausted")
+		}
+		require.NoError(t, k.Init())
+		failures := k.uuidErrors.Get()
+
+		keys := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			key := k.getPartitionKey(testPoint)
+			require.NotEqual(t, "default", key)
+			keys[key] = true
+		}
+		require.Len(t, keys, 10, "fallback keys should be unique")
+		require.Equal(t, failures+10, k.uuidErrors.Get())
+	}
+}
+
+func TestPartitionKey_MultipleTags(t *testing.T) {
+	full := testutil.MustMetric("cpu",
+		map[string]string{"region": "eu-west-1", "service": "api"},
+		map[string]interface{}{"value": 1},
+		time.Unix(0, 0),
+	)
+	partial := testutil.MustMetric("cpu",
+		map[string]string{"region": "eu-west-1"},
+		map[string]interface{}{"value": 1},
+		time.Unix(0, 0),
+	)
+	none := testutil.MustMetric("cpu",
+		map[string]string{},
+		map[string]interface{}{"value": 1},
+		time.Unix(0, 0),
+	)
+
+	tests := []struct {
+		name      string
+		partition *Partition
+		expected  []string
+	}{
+		{
+			name:      "default separator",
+			partition: &Partition{Method: "tag", Keys: []string{"region", "service"}},
+			expected:  []string{"eu-west-1/api", "telegraf", "telegraf"},
+		},
+		{
+			name: "separator and default",
+			partition: &Partition{
+				Method:    "tag",
+				Keys:      []string{"region", "service"},
+				Separator: "|",
+				Default:   "somedefault",
+			},
+			expected: []string{"eu-west-1|api", "somedefault", "somedefault"},
+		},
+		{
+			name: "empty missing tags",
+			partition: &Partition{
+				Method:      "tag",
+				Keys:        []string{"region", "service"},
+				MissingTags: "empty",
+			},
+			expected: []string{"eu-west-1/api", "eu-west-1/", "/"},
+		},
+		{
+			name: "single empty missing tag",
+			partition: &Partition{
+				Method:      "tag",
+				Keys:        []string{"service"},
+				MissingTags: "empty",
+				Default:     "somedefault",
+			},
+			expected: []string{"api", "somedefault", "somedefault"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KinesisOutput{
+				Log:       testutil.Logger{},
+				Partition: tt.partition,
+			}
+			require.NoError(t, k.Init())
+			for i, metric := range []telegraf.Metric{full, partial, none} {
+				require.Equal(t, tt.expected[i], k.getPartitionKey(metric))
+			}
+		})
+	}
+}
+
+func TestInit_InvalidMultipleTagPartition(t *testing.T) {
+	for _, partition := range []*Partition{
+		{Method: "measurement_tag", Keys: []string{"region"}},
+		{Method: "tag", Key: "host", Keys: []string{"region"}},
+		{Method: "tag", Keys: []string{"region"}, MissingTags: "skip"},
+	} {
+		k := KinesisOutput{
+			Log:       testutil.Logger{},
+			Partition: partition,
+		}
+		require.Error(t, k.Init())
+	}
+}
+
+func TestPartitionKey_Template(t *testing.T) {
+	testPoint := testutil.TestMetric(1)
+
+	tests := []struct {
+		name      string
+		template  string
+		partition *Partition
+		expected  string
+	}{
+		{
+			name:     "tag and name",
+			template: `{{ .Tag "tag1" }}-{{ .Name }}`,
+			expected: "value1-test1",
+		},
+		{
+			name:     "field and time",
+			template: `{{ .Field "value" }}/{{ .Time.Unix }}`,
+			expected: fmt.Sprintf("1/%d", testPoint.Time().Unix()),
+		},
+		{
+			name:     "tags map",
+			template: `{{ index .Tags "tag1" }}`,
+			expected: "value1",
+		},
+		{
+			name:     "missing tag",
+			template: `{{ .Tag "doesnotexist" }}-{{ .Name }}`,
+			expected: "-test1",
+		},
+		{
+			name:     "empty result",
+			template: `{{ .Tag "doesnotexist" }}`,
+			expected: "telegraf",
+		},
+		{
+			name:      "empty result with default",
+			template:  `{{ .Tag "doesnotexist" }}`,
+			partition: &Partition{Method: "static", Key: "static", Default: "somedefault"},
+			expected:  "somedefault",
+		},
+		{
+			name:     "truncated",
+			template: strings.Repeat("k", maxPartitionKeyLength+1),
+			expected: strings.Repeat("k", maxPartitionKeyLength),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KinesisOutput{
+				Log:               testutil.Logger{},
+				Partition:         tt.partition,
+				PartitionTemplate: tt.template,
+			}
+			require.NoError(t, k.Init())
+			require.Equal(t, tt.expected, k.getPartitionKey(testPoint))
+		})
+	}
+}
+
+func TestInit_InvalidPartitionTemplate(t *testing.T) {
+	k := KinesisOutput{
+		Log:               testutil.Logger{},
+		PartitionTemplate: `{{ .Tag "region" `,
+	}
+	require.Error(t, k.Init())
+}
+
+func TestResolveEndpointURL(t *testing.T) {
+	tests := []struct {
+		name           string
+		endpointURL    string
+		env            map[string]string
+		expected       string
+		expectedSource string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:           "global env",
+			env:            map[string]string{"AWS_ENDPOINT_URL": "http://global:4566"},
+			expected:       "http://global:4566",
+			expectedSource: "AWS_ENDPOINT_URL",
+		},
+		{
+			name: "service env over global env",
+			env: map[string]string{
+				"AWS_ENDPOINT_URL":         "http://global:4566",
+				"AWS_ENDPOINT_URL_KINESIS": "http://kinesis:4566",
+			},
+			expected:       "http://kinesis:4566",
+			expectedSource: "AWS_ENDPOINT_URL_KINESIS",
+		},
+		{
+			name:        "config over env",
+			endpointURL: "http://config:4566",
+			env: map[string]string{
+				"AWS_ENDPOINT_URL":         "http://global:4566",
+				"AWS_ENDPOINT_URL_KINESIS": "http://kinesis:4566",
+			},
+			expected:       "http://config:4566",
+			expectedSource: "endpoint_url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_KINESIS"} {
+				value, ok := os.LookupEnv(env)
+				os.Unsetenv(env)
+				if ok {
+					defer os.Setenv(env, value)
+				} else {
+					defer os.Unsetenv(env)
+				}
+			}
+			for env, value := range tt.env {
+				os.Setenv(env, value)
+			}
+
+			k := KinesisOutput{
+				Log:         testutil.Logger{},
+				EndpointURL: tt.endpointURL,
+			}
+			endpointURL, source := k.resolveEndpointURL()
+			require.Equal(t, tt.expected, endpointURL)
+			require.Equal(t, tt.expectedSource, source)
+		})
+	}
+}
+
+func TestPartitionID(t *testing.T) {
+	tests := []struct {
+		name        string
+		region      string
+		partitionID string
+		expected    string
+		expectErr   bool
+	}{
+		{
+			name:     "govcloud without partition",
+			region:   "us-gov-west-1",
+			expected: "https://kinesis.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:        "govcloud with partition",
+			region:      "us-gov-west-1",
+			partitionID: "aws-us-gov",
+			expected:    "https://kinesis.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:        "china with partition",
+			region:      "cn-north-1",
+			partitionID: "aws-cn",
+			expected:    "https://kinesis.cn-north-1.amazonaws.com.cn",
+		},
+		{
+			name:        "govcloud region in standard partition",
+			region:      "us-gov-west-1",
+			partitionID: "aws",
+			expectErr:   true,
+		},
+		{
+			name:        "unknown partition",
+			region:      "us-east-1",
+			partitionID: "aws-moon",
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KinesisOutput{
+				Log:         testutil.Logger{},
+				Region:      tt.region,
+				PartitionID: tt.partitionID,
+			}
+			err := k.Init()
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			sess := session.Must(session.NewSession(&aws.Config{
+				Region: aws.String(tt.region),
+			}))
+			svc := kinesis.New(sess, k.clientConfig())
+			require.Equal(t, tt.expected, svc.Endpoint)
+		})
+	}
+}
+
+func TestClientConfig_Transport(t *testing.T) {
+	k := KinesisOutput{}
+	transport := k.clientConfig().HTTPClient.Transport.(*http.Transport)
+	require.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	require.Equal(t, 100, transport.MaxIdleConns)
+	require.Equal(t, 100, transport.MaxIdleConnsPerHost)
+	require.NotNil(t, transport.Proxy)
+	require.Equal(t, 30*time.Second, k.dialer().KeepAlive)
+
+	k = KinesisOutput{
+		IdleConnTimeout: internal.Duration{Duration: 5 * time.Minute},
+		MaxIdleConns:    20,
+		KeepAlive:       internal.Duration{Duration: -1},
+	}
+	transport = k.clientConfig().HTTPClient.Transport.(*http.Transport)
+	require.Equal(t, 5*time.Minute, transport.IdleConnTimeout)
+	require.Equal(t, 20, transport.MaxIdleConns)
+	require.Equal(t, 20, transport.MaxIdleConnsPerHost)
+	require.Equal(t, time.Duration(-1), k.dialer().KeepAlive)
+}
+
+func TestApplySigningOverrides(t *testing.T) {
+	tests := []struct {
+		name          string
+		signingName   string
+		signingRegion string
+		expectedScope string
+	}{
+		{
+			name:          "default",
+			expectedScope: "/us-east-1/kinesis/aws4_request",
+		},
+		{
+			name:          "overridden",
+			signingName:   "proxy",
+			signingRegion: "eu-west-1",
+			expectedScope: "/eu-west-1/proxy/aws4_request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KinesisOutput{
+				Log:           testutil.Logger{},
+				SigningName:   tt.signingName,
+				SigningRegion: tt.signingRegion,
+			}
+
+			svc := kinesis.New(session.Must(session.NewSession(&aws.Config{
+				Region:      aws.String("us-east-1"),
+				Endpoint:    aws.String("http://localhost:4566"),
+				Credentials: credentials.NewStaticCredentials("access", "secret", ""),
+			})))
+			k.applySigningOverrides(svc.Client)
+
+			req, _ := svc.PutRecordsRequest(&kinesis.PutRecordsInput{
+				StreamName: aws.String("stream"),
+				Records: []*kinesis.PutRecordsRequestEntry{
+					{
+						PartitionKey: aws.String("partitionKey"),
+						Data:         []byte{0x65},
+					},
+				},
+			})
+			require.NoError(t, req.Sign())
+			require.Contains(t, req.HTTPRequest.Header.Get("Authorization"), tt.expectedScope)
+		})
+	}
+}
+
+func TestUserAgentHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "default",
+			expected: internal.ProductToken() + " outputs.kinesis",
+		},
+		{
+			name:      "custom",
+			userAgent: "my-pipeline/1.0",
+			expected:  "my-pipeline/1.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := KinesisOutput{
+				Log:       testutil.Logger{},
+				UserAgent: tt.userAgent,
+			}
+
+			svc := kinesis.New(session.Must(session.NewSession(&aws.Config{
+				Region: aws.String("us-east-1"),
+			})))
+			handlers := svc.Handlers.Build.Len()
+			svc.Handlers.Build.PushBackNamed(k.userAgentHandler())
+			require.Equal(t, handlers+1, svc.Handlers.Build.Len())
+
+			req, _ := svc.PutRecordsRequest(&kinesis.PutRecordsInput{
+				StreamName: aws.String("stream"),
+				Records: []*kinesis.PutRecordsRequestEntry{
+					{
+						PartitionKey: aws.String("partitionKey"),
+						Data:         []byte{0x65},
+					},
+				},
+			})
+			require.NoError(t, req.Build())
+			require.True(t,
+				strings.HasSuffix(req.HTTPRequest.Header.Get("User-Agent"), tt.expected),
+				"User-Agent %q should end with %q", req.HTTPRequest.Header.Get("User-Agent"), tt.expected,
+			)
+		})
+	}
+}
+
+func TestNew_InjectedClient(t *testing.T) {
+	describe := &mockKinesisDescribeStreamSummary{}
+	describe.SetupResponse(kinesis.StreamStatusActive)
+	svc := &mockKinesisPutRecords{KinesisAPI: describe}
+	svc.SetupGenericResponse(2, 0)
+
+	serializer := influx.NewSerializer()
+	k := New(svc, serializer)
+	k.Log = testutil.Logger{}
+	k.StreamName = "stream"
+	k.Partition = &Partition{Method: "measurement"}
+	require.NoError(t, k.Init())
+
+	// Connect validates the stream with the injected client instead of
+	// creating one
+	require.NoError(t, k.Connect())
+	defer k.Close()
+	require.Len(t, describe.requests, 1)
+	require.Equal(t, kinesis.StreamStatusActive, k.getStreamStatus())
+
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+	require.NoError(t, k.Write(metrics))
+
+	require.Len(t, svc.requests, 1)
+	require.Equal(t, "stream", aws.StringValue(svc.requests[0].StreamName))
+	for i, record := range svc.requests[0].Records {
+		require.Equal(t, metricsData[i], record.Data)
+	}
+}
+
+func TestConnect_JitterInterruptedByClose(t *testing.T) {
+	k := KinesisOutput{
+		Log:           testutil.Logger{},
+		Region:        "us-east-1",
+		StreamName:    "stream",
+		Partition:     &Partition{Method: "random"},
+		ConnectJitter: internal.Duration{Duration: time.Hour},
+	}
+	require.NoError(t, k.Init())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		k.Close()
+	}()
+
+	start := time.Now()
+	err := k.Connect()
+	require.Equal(t, context.Canceled, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Minute))
+}
+
+func TestCheckStream_StatusTransitions(t *testing.T) {
+	svc := &mockKinesisDescribeStreamSummary{}
+	svc.SetupResponse(kinesis.StreamStatusActive)
+	svc.SetupResponse(kinesis.StreamStatusUpdating)
+	svc.SetupResponse(kinesis.StreamStatusDeleting)
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: "stream",
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	_, err := k.describeStream(k.StreamName)
+	require.NoError(t, err)
+	require.Equal(t, kinesis.StreamStatusActive, k.getStreamStatus())
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.checkStream(time.Millisecond)
+	}()
+
+	require.Eventually(t, func() bool {
+		return k.getStreamStatus() == kinesis.StreamStatusDeleting
+	}, time.Second, time.Millisecond)
+	require.NoError(t, k.Close())
+	require.GreaterOrEqual(t, svc.RequestCount(), 3)
+}
+
+func TestValidateStream_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "not found",
+			err:      awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream stream not found", nil),
+			expected: "must be created before starting telegraf",
+		},
+		{
+			name:     "access denied",
+			err:      awserr.New("AccessDeniedException", "User is not authorized", nil),
+			expected: "kinesis:DescribeStreamSummary",
+		},
+		{
+			name:     "other",
+			err:      awserr.New(kinesis.ErrCodeLimitExceededException, "Rate exceeded", nil),
+			expected: "Rate exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisDescribeStreamSummary{}
+			svc.SetupErrorResponse(tt.err)
+
+			k := KinesisOutput{
+				Log:        testutil.Logger{},
+				Region:     "us-east-1",
+				StreamName: "stream",
+				svc:        svc,
+			}
+			require.NoError(t, k.Init())
+
+			err := k.validateStream()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.expected)
+			require.Contains(t, err.Error(), tt.err.Error())
+		})
+	}
+}
+
+func TestValidateStream_Retries(t *testing.T) {
+	transient := awserr.New(request.ErrCodeRequestError, "send request failed", nil)
+
+	tests := []struct {
+		name       string
+		errors     []error
+		maxRetries int
+		expectErr  bool
+		requests   int
+	}{
+		{
+			name:       "succeeds after transient errors",
+			errors:     []error{transient, transient},
+			maxRetries: 3,
+			requests:   3,
+		},
+		{
+			name:       "retries exhausted",
+			errors:     []error{transient, transient},
+			maxRetries: 1,
+			expectErr:  true,
+			requests:   2,
+		},
+		{
+			name:      "retries disabled",
+			errors:    []error{transient},
+			expectErr: true,
+			requests:  1,
+		},
+		{
+			name:       "stream not found is not retried",
+			errors:     []error{awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream stream not found", nil)},
+			maxRetries: 3,
+			expectErr:  true,
+			requests:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisDescribeStreamSummary{}
+			for _, err := range tt.errors {
+				svc.SetupErrorResponse(err)
+			}
+			svc.SetupResponse(kinesis.StreamStatusActive)
+
+			k := KinesisOutput{
+				Log:               testutil.Logger{},
+				StreamName:        "stream",
+				ConnectMaxRetries: tt.maxRetries,
+				svc:               svc,
+				connectRetryDelay: time.Millisecond,
+			}
+			require.NoError(t, k.Init())
+
+			err := k.validateStream()
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.requests, svc.RequestCount())
+		})
+	}
+}
+
+func TestValidateStream_Encryption(t *testing.T) {
+	tests := []struct {
+		name               string
+		encryptionType     string
+		encryptionRequired bool
+		expectErr          bool
+	}{
+		{
+			name:           "unencrypted",
+			encryptionType: kinesis.EncryptionTypeNone,
+		},
+		{
+			name:               "unencrypted required",
+			encryptionType:     kinesis.EncryptionTypeNone,
+			encryptionRequired: true,
+			expectErr:          true,
+		},
+		{
+			name:               "unreported required",
+			encryptionRequired: true,
+			expectErr:          true,
+		},
+		{
+			name:               "encrypted required",
+			encryptionType:     kinesis.EncryptionTypeKms,
+			encryptionRequired: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisDescribeStreamSummary{}
+			svc.SetupEncryptionResponse(tt.encryptionType)
+
+			log := &recordingLogger{}
+			k := KinesisOutput{
+				Log:                log,
+				StreamName:         "stream",
+				EncryptionRequired: tt.encryptionRequired,
+				svc:                svc,
+			}
+			require.NoError(t, k.Init())
+
+			err := k.validateStream()
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "not encrypted")
+			} else {
+				require.NoError(t, err)
+			}
+
+			expected := tt.encryptionType
+			if expected == "" {
+				expected = kinesis.EncryptionTypeNone
+			}
+			require.Contains(t, log.Messages("I!"), `Stream "stream" encryption type is `+expected)
+		})
+	}
+}
+
 func TestWriteKinesis_WhenSuccess(t *testing.T) {
 
 	assert := assert.New(t)
@@ -137,130 +905,1453 @@ func TestWriteKinesis_WhenSuccess(t *testing.T) {
 		StreamName: streamName,
 		svc:        svc,
 	}
+	require.NoError(t, k.Init())
+
+	result := k.writeKinesis(k.StreamName, records)
+	assert.GreaterOrEqual(result.elapsed.Nanoseconds(), zero)
+	assert.Equal(0, result.failed)
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+	})
+}
+
+func TestWriteKinesis_ShardFanout(t *testing.T) {
+	records := createWALRecords("a", "b", "c", "d", "e")
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupResponse(1, []*kinesis.PutRecordsResultEntry{
+		{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")},
+		{SequenceNumber: aws.String("2"), ShardId: aws.String("shardId-000000000001")},
+		{SequenceNumber: aws.String("3"), ShardId: aws.String("shardId-000000000000")},
+		{SequenceNumber: aws.String("4"), ShardId: aws.String("shardId-000000000002")},
+		{ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String("Internal Service Failure")},
+	})
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: "stream",
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	k.writeKinesis(k.StreamName, records)
+	require.Equal(t, int64(3), k.shardFanout.Get())
+}
+
+func TestWriteKinesis_WhenRecordErrors(t *testing.T) {
+
+	assert := assert.New(t)
+
+	errorCode := "InternalFailure"
+	errorMessage := "Internal Service Failure"
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x66},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupResponse(
+		1,
+		[]*kinesis.PutRecordsResultEntry{
+			{
+				ErrorCode:      &errorCode,
+				ErrorMessage:   &errorMessage,
+				SequenceNumber: nil,
+				ShardId:        nil,
+			},
+		},
+	)
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: streamName,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	result := k.writeKinesis(k.StreamName, records)
+	assert.GreaterOrEqual(result.elapsed.Nanoseconds(), zero)
+	assert.Equal(1, result.failed)
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+	})
+}
+
+func TestWriteKinesis_LogSequenceNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x65},
+		},
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x66},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 1)
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:                log,
+		StreamName:         streamName,
+		LogSequenceNumbers: true,
+		svc:                svc,
+	}
+	require.NoError(t, k.Init())
+
+	k.writeKinesis(k.StreamName, records)
+
+	messages := log.Messages("D!")
+	assert.Equal(1, len(messages))
+	assert.Contains(messages[0], `"partitionKey"`)
+	assert.Contains(messages[0], "shardId-000000000003")
+	assert.Contains(messages[0], "sequence number 0")
+}
+
+func TestWriteKinesis_PartialFailureLogThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		failed    uint32
+		warnings  int
+		errors    int
+	}{
+		{
+			name:      "below threshold",
+			threshold: 0.5,
+			failed:    1,
+		},
+		{
+			name:      "above threshold",
+			threshold: 0.5,
+			failed:    6,
+			warnings:  1,
+		},
+		{
+			name:   "disabled",
+			failed: 1,
+			errors: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(10-tt.failed, tt.failed)
+
+			log := &recordingLogger{}
+			k := KinesisOutput{
+				Log:                        log,
+				StreamName:                 "stream",
+				PartialFailureLogThreshold: tt.threshold,
+				svc:                        svc,
+			}
+			require.NoError(t, k.Init())
+
+			before := k.recordsFailed.Get()
+			records := []*kinesis.PutRecordsRequestEntry{}
+			for i := 0; i < 10; i++ {
+				records = append(records, &kinesis.PutRecordsRequestEntry{
+					PartitionKey: aws.String("key"),
+					Data:         []byte("data"),
+				})
+			}
+			result := k.writeKinesis(k.StreamName, records)
+			require.Equal(t, int(tt.failed), result.failed)
+
+			require.Equal(t, before+int64(tt.failed), k.recordsFailed.Get())
+			require.Len(t, log.Messages("W!"), tt.warnings)
+			require.Len(t, log.Messages("E!"), tt.errors)
+		})
+	}
+}
+
+func TestInit_InvalidPartialFailureLogThreshold(t *testing.T) {
+	for _, threshold := range []float64{-0.1, 1.5} {
+		k := KinesisOutput{
+			Log:                        testutil.Logger{},
+			PartialFailureLogThreshold: threshold,
+		}
+		require.Error(t, k.Init())
+	}
+}
+
+func TestWriteKinesis_WhenResultCountMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x65},
+		},
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x66},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 0)
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:                log,
+		StreamName:         streamName,
+		LogSequenceNumbers: true,
+		svc:                svc,
+	}
+	require.NoError(t, k.Init())
+	failed := k.recordsFailed.Get()
+
+	result := k.writeKinesis(k.StreamName, records)
+	assert.GreaterOrEqual(result.elapsed.Nanoseconds(), zero)
+	assert.Equal(2, result.failed)
+	assert.Equal(2, result.mismatched)
+	assert.Equal(records, result.errored)
+	assert.Equal(failed+2, k.recordsFailed.Get())
+
+	errors := log.Messages("E!")
+	assert.Equal(1, len(errors))
+	assert.Contains(errors[0], "response contained 1 result(s)")
+	assert.Empty(log.Messages("D!"))
+
+	// the batch is retried with retry_on_throttle
+	svc.SetupGenericResponse(1, 0)
+	serializer := influx.NewSerializer()
+	k.Partition = &Partition{Method: "static", Key: partitionKey}
+	k.RetryOnThrottle = true
+	k.serializer = serializer
+	metrics, _ := createTestMetrics(t, 2, serializer)
+	require.EqualError(t, k.Write(metrics),
+		"2 of 2 record(s) got a response from Kinesis without their result, retrying on the next flush")
+}
+
+func TestWriteKinesis_BytesWritten(t *testing.T) {
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x65, 0x66},
+		},
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x67, 0x68, 0x69},
+		},
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x70},
+		},
+	}
+
+	// the last record fails and is not counted
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 1)
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: streamName,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+	before := k.bytesWritten.Get()
+
+	k.writeKinesis(k.StreamName, records)
+
+	expected := int64(2 + 3 + 2*len(partitionKey))
+	assert.Equal(expected, k.bytesWritten.Get()-before)
+}
+
+func TestWriteKinesis_WhenServiceError(t *testing.T) {
+
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupErrorResponse(
+		awserr.New("InvalidArgumentException", "Invalid record", nil),
+	)
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		StreamName: streamName,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	result := k.writeKinesis(k.StreamName, records)
+	assert.GreaterOrEqual(result.elapsed.Nanoseconds(), zero)
+	assert.Equal(1, result.failed)
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+	})
+}
+
+func TestWriteKinesis_WhenTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x65},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupHangingResponse()
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:               log,
+		StreamName:        streamName,
+		PutRecordsTimeout: internal.Duration{Duration: 10 * time.Millisecond},
+		svc:               svc,
+	}
+	require.NoError(t, k.Init())
+
+	result := k.writeKinesis(k.StreamName, records)
+	assert.GreaterOrEqual(int64(result.elapsed), int64(10*time.Millisecond))
+	assert.Less(int64(result.elapsed), int64(time.Minute))
+
+	errors := log.Messages("E!")
+	assert.Equal(1, len(errors))
+	assert.Contains(errors[0], "timed out")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+	})
+}
+
+func TestWriteKinesis_WhenExpiredToken(t *testing.T) {
+	assert := assert.New(t)
+
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: &partitionKey,
+			Data:         []byte{0x65},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupErrorResponse(
+		awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil),
+	)
+	svc.SetupGenericResponse(1, 0)
+
+	provider := &countingCredentialsProvider{}
+	creds := credentials.NewCredentials(provider)
+	_, err := creds.Get()
+	require.NoError(t, err)
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:         log,
+		StreamName:  streamName,
+		svc:         svc,
+		credentials: creds,
+	}
+	require.NoError(t, k.Init())
+
+	k.writeKinesis(k.StreamName, records)
+
+	assert.Equal(2, provider.retrieved, "Credentials should be retrieved again")
+	assert.Empty(log.Messages("E!"))
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+		{
+			StreamName: &streamName,
+			Records:    records,
+		},
+	})
+}
+
+func TestWrite_NoMetrics(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	svc := &mockKinesisPutRecords{}
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "partitionKey",
+		},
+		StreamName: "stream",
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	err := k.Write([]telegraf.Metric{})
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{})
+}
+
+func TestWrite_SingleMetric(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metric, metricData := createTestMetric(t, "metric1", serializer)
+	err := k.Write([]telegraf.Metric{metric})
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{
+					PartitionKey: &partitionKey,
+					Data:         metricData,
+				},
+			},
+		},
+	})
+}
+
+func TestWrite_MultipleMetrics_SinglePartialRequest(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(3, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, metricsData := createTestMetrics(t, 3, serializer)
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
+		},
+	})
+}
+
+func TestWrite_MultipleMetrics_SingleFullRequest(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest, serializer)
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
+		},
+	})
+}
+
+func TestWrite_MultipleMetrics_MultipleRequests(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+	svc.SetupGenericResponse(1, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest+1, serializer)
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData[0:maxRecordsPerRequest],
+				&partitionKey,
+			),
+		},
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData[maxRecordsPerRequest:],
+				&partitionKey,
+			),
+		},
+	})
+}
+
+func TestWrite_MultipleMetrics_MultipleFullRequests(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest*2, serializer)
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData[0:maxRecordsPerRequest],
+				&partitionKey,
+			),
+		},
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData[maxRecordsPerRequest:],
+				&partitionKey,
+			),
+		},
+	})
+}
+
+func TestWrite_MultiplePartitionKeys_SingleRequest(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(3, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "tag",
+			Key:    "tenant",
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics := []telegraf.Metric{}
+	metricsData := [][]byte{}
+	for _, tenant := range []string{"a", "b", "c"} {
+		metric := testutil.MustMetric(
+			"metric",
+			map[string]string{"tenant": tenant},
+			map[string]interface{}{"value": 1},
+			time.Unix(0, 0),
+		)
+		data, err := serializer.Serialize(metric)
+		require.NoError(t, err)
+
+		metrics = append(metrics, metric)
+		metricsData = append(metricsData, data)
+	}
+
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	keyA, keyB, keyC := "a", "b", "c"
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{
+					PartitionKey: &keyA,
+					Data:         metricsData[0],
+				},
+				{
+					PartitionKey: &keyB,
+					Data:         metricsData[1],
+				},
+				{
+					PartitionKey: &keyC,
+					Data:         metricsData[2],
+				},
+			},
+		},
+	})
+}
+
+func TestWrite_PrometheusRemoteWrite_OneWriteRequestPerRecord(t *testing.T) {
+	serializer, err := prometheusremotewrite.NewSerializer(prometheusremotewrite.FormatConfig{})
+	require.NoError(t, err)
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(3, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "measurement",
+		},
+		StreamName: "stream",
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics := []telegraf.Metric{
+		testutil.MustMetric("cpu", map[string]string{"host": "a"}, map[string]interface{}{"usage": 1.0}, time.Unix(0, 0)),
+		testutil.MustMetric("mem", map[string]string{"host": "a"}, map[string]interface{}{"used": 2.0}, time.Unix(0, 0)),
+		testutil.MustMetric("disk", map[string]string{"host": "a"}, map[string]interface{}{"free": 3.0}, time.Unix(0, 0)),
+	}
+	require.NoError(t, k.Write(metrics))
+
+	require.Len(t, svc.requests, 1)
+	require.Len(t, svc.requests[0].Records, len(metrics))
+	for i, record := range svc.requests[0].Records {
+		decoded, err := snappy.Decode(nil, record.Data)
+		require.NoError(t, err)
+
+		var req prompb.WriteRequest
+		require.NoError(t, proto.Unmarshal(decoded, &req))
+		require.Len(t, req.Timeseries, 1)
+		require.Equal(t, metrics[i].Name(), *record.PartitionKey)
+	}
+}
+
+func TestWrite_MaxMetricsPerWrite(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	chunkSize := 300
+	chunks := 4
+
+	svc := &mockKinesisPutRecords{}
+	for i := 0; i < chunks; i++ {
+		svc.SetupGenericResponse(uint32(chunkSize), 0)
+	}
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName:         streamName,
+		MaxMetricsPerWrite: chunkSize,
+		serializer:         serializer,
+		svc:                svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, metricsData := createTestMetrics(t, uint32(chunkSize*chunks), serializer)
+	err := k.Write(metrics)
+	assert.Nil(err, "Should not return error")
+
+	expected := []*kinesis.PutRecordsInput{}
+	for i := 0; i < chunks; i++ {
+		expected = append(expected, &kinesis.PutRecordsInput{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData[i*chunkSize:(i+1)*chunkSize],
+				&partitionKey,
+			),
+		})
+	}
+	svc.AssertRequests(assert, expected)
+}
+
+func TestWrite_MaxMetricsPerWriteSendsEachChunk(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(2, 0)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:             "stream",
+				MaxMetricsPerWrite:     2,
+				SerializeErrorBehavior: "error",
+				Strict:                 strict,
+				serializer:             &failingSerializer{Serializer: influx.NewSerializer(), failOn: "bad"},
+				svc:                    svc,
+			}
+			require.NoError(t, k.Init())
+
+			metrics := []telegraf.Metric{
+				testutil.TestMetric(1, "good"),
+				testutil.TestMetric(2, "good"),
+				testutil.TestMetric(3, "bad"),
+			}
+			require.Error(t, k.Write(metrics))
+
+			// the first chunk is sent before the second is serialized,
+			// unless nothing may be sent before every chunk is serialized
+			if strict {
+				require.Empty(t, svc.requests)
+			} else {
+				require.Len(t, svc.requests, 1)
+			}
+		})
+	}
+}
+
+func TestBatchRecords(t *testing.T) {
+	records := func(keys ...string) []*kinesis.PutRecordsRequestEntry {
+		r := []*kinesis.PutRecordsRequestEntry{}
+		for _, key := range keys {
+			r = append(r, &kinesis.PutRecordsRequestEntry{
+				PartitionKey: aws.String(key),
+				Data:         []byte(key),
+			})
+		}
+		return r
+	}
+
+	k := KinesisOutput{
+		Log:               testutil.Logger{},
+		MaxKeysPerRequest: 2,
+	}
+	require.Equal(t, [][]*kinesis.PutRecordsRequestEntry{
+		records("a", "b", "a"),
+		records("c", "d"),
+		records("a"),
+	}, k.batchRecords(records("a", "b", "a", "c", "d", "a")))
+
+	// the request size limit still applies when every record has the same key
+	same := make([]string, 2*maxRecordsPerRequest+1)
+	for i := range same {
+		same[i] = "a"
+	}
+	batches := k.batchRecords(records(same...))
+	require.Len(t, batches, 3)
+	require.Len(t, batches[0], int(maxRecordsPerRequest))
+	require.Len(t, batches[1], int(maxRecordsPerRequest))
+	require.Len(t, batches[2], 1)
+
+	k.MaxKeysPerRequest = 0
+	require.Len(t, k.batchRecords(records("a", "b", "c", "d")), 1)
+	require.Empty(t, k.batchRecords(nil))
+}
+
+func TestBatchRecords_RequestSizeLimit(t *testing.T) {
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+	}
+
+	// five records of the maximum size exactly fill a request, counting
+	// the partition keys
+	key := "k"
+	r := []*kinesis.PutRecordsRequestEntry{}
+	for i := 0; i < 5; i++ {
+		r = append(r, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(key),
+			Data:         make([]byte, maxRecordSize-len(key)),
+		})
+	}
+	require.Len(t, k.batchRecords(r), 1)
+
+	// a small record pushes the total just over the limit
+	r = append(r, &kinesis.PutRecordsRequestEntry{
+		PartitionKey: aws.String(key),
+		Data:         []byte{0x65},
+	})
+	batches := k.batchRecords(r)
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 5)
+	require.Len(t, batches[1], 1)
+
+	for _, batch := range batches {
+		size := 0
+		for _, record := range batch {
+			size += len(record.Data) + len(aws.StringValue(record.PartitionKey))
+		}
+		require.LessOrEqual(t, size, maxRequestSize)
+	}
+}
+
+func TestWrite_PerKeyOrdering(t *testing.T) {
+	serializer := influx.NewSerializer()
+
+	svc := &mockKinesisPutRecords{}
+	for i := 0; i < 3; i++ {
+		svc.SetupGenericResponse(2, 0)
+	}
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "tag",
+			Key:    "host",
+		},
+		StreamName:        "stream",
+		MaxKeysPerRequest: 1,
+		serializer:        serializer,
+		svc:               svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics := []telegraf.Metric{}
+	for i, host := range []string{"a", "a", "b", "b", "a", "a"} {
+		metrics = append(metrics, testutil.MustMetric(
+			"cpu",
+			map[string]string{"host": host},
+			map[string]interface{}{"value": i},
+			time.Unix(int64(i), 0),
+		))
+	}
+	require.NoError(t, k.Write(metrics))
+
+	require.Len(t, svc.requests, 3)
+	assertPerKeyOrdering(t, svc.requests)
+
+	sequences := partitionKeySequences(t, svc.requests)
+	require.Len(t, sequences["a"], 4)
+	require.Len(t, sequences["b"], 2)
+}
+
+func TestWrite_SerializerError(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metric1, metric1Data := createTestMetric(t, "metric1", serializer)
+	metric2, metric2Data := createTestMetric(t, "metric2", serializer)
+
+	// metric is invalid because of empty name
+	invalidMetric := testutil.TestMetric(3, "")
+
+	err := k.Write([]telegraf.Metric{
+		metric1,
+		invalidMetric,
+		metric2,
+	})
+	assert.Nil(err, "Should not return error")
+
+	// remaining valid metrics should still get written
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{
+					PartitionKey: &partitionKey,
+					Data:         metric1Data,
+				},
+				{
+					PartitionKey: &partitionKey,
+					Data:         metric2Data,
+				},
+			},
+		},
+	})
+}
+
+func TestWrite_SerializerErrorBehavior(t *testing.T) {
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	tests := []struct {
+		name        string
+		behavior    string
+		expectError bool
+		requests    int
+	}{
+		{
+			name:     "default skips metric",
+			requests: 1,
+		},
+		{
+			name:     "skip",
+			behavior: "skip",
+			requests: 1,
+		},
+		{
+			name:        "error",
+			behavior:    "error",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := &failingSerializer{
+				Serializer: influx.NewSerializer(),
+				failOn:     "bad",
+			}
+
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(2, 0)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    partitionKey,
+				},
+				StreamName:             streamName,
+				SerializeErrorBehavior: tt.behavior,
+				serializer:             serializer,
+				svc:                    svc,
+			}
+			require.NoError(t, k.Init())
+			before := k.serializeErrors.Get()
+
+			err := k.Write([]telegraf.Metric{
+				testutil.TestMetric(1, "good1"),
+				testutil.TestMetric(2, "bad"),
+				testutil.TestMetric(3, "good2"),
+			})
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, int64(1), k.serializeErrors.Get()-before)
+			require.Len(t, svc.requests, tt.requests)
+		})
+	}
+}
+
+func TestWrite_EmptySerializedOutput(t *testing.T) {
+	assert := assert.New(t)
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	serializer := &emptySerializer{
+		Serializer: influx.NewSerializer(),
+		emptyOn:    "filtered",
+	}
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName: streamName,
+		serializer: serializer,
+		svc:        svc,
+	}
+	require.NoError(t, k.Init())
+
+	metric1, metric1Data := createTestMetric(t, "metric1", serializer)
+	metric2, metric2Data := createTestMetric(t, "metric2", serializer)
+
+	err := k.Write([]telegraf.Metric{
+		metric1,
+		testutil.TestMetric(2, "filtered"),
+		metric2,
+	})
+	assert.Nil(err, "Should not return error")
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: []*kinesis.PutRecordsRequestEntry{
+				{
+					PartitionKey: &partitionKey,
+					Data:         metric1Data,
+				},
+				{
+					PartitionKey: &partitionKey,
+					Data:         metric2Data,
+				},
+			},
+		},
+	})
+}
+
+func TestWrite_MaxMetricAge(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName:   streamName,
+		MaxMetricAge: internal.Duration{Duration: time.Hour},
+		serializer:   serializer,
+		svc:          svc,
+	}
+	require.NoError(t, k.Init())
+	before := k.staleMetricsDropped.Get()
+
+	now := time.Now()
+	fresh1 := testutil.MustMetric("fresh1", map[string]string{}, map[string]interface{}{"value": 1}, now)
+	fresh2 := testutil.MustMetric("fresh2", map[string]string{}, map[string]interface{}{"value": 2}, now.Add(-time.Minute))
+	stale1 := testutil.MustMetric("stale1", map[string]string{}, map[string]interface{}{"value": 3}, now.Add(-2*time.Hour))
+	stale2 := testutil.MustMetric("stale2", map[string]string{}, map[string]interface{}{"value": 4}, now.Add(-24*time.Hour))
+
+	fresh1Data, err := serializer.Serialize(fresh1)
+	require.NoError(t, err)
+	fresh2Data, err := serializer.Serialize(fresh2)
+	require.NoError(t, err)
+
+	err = k.Write([]telegraf.Metric{stale1, fresh1, stale2, fresh2})
+	assert.Nil(err, "Should not return error")
+	assert.Equal(int64(2), k.staleMetricsDropped.Get()-before)
+
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				[][]byte{fresh1Data, fresh2Data},
+				&partitionKey,
+			),
+		},
+	})
+}
+
+func TestWrite_MinFlushBytes(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	metrics, metricsData := createTestMetrics(t, 3, serializer)
+	recordSize := int64(len(metricsData[0]) + len(partitionKey))
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(3, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName:    streamName,
+		MinFlushBytes: internal.Size{Size: 3 * recordSize},
+		serializer:    serializer,
+		svc:           svc,
+	}
+	require.NoError(t, k.Init())
+
+	require.NoError(t, k.Write(metrics[0:1]))
+	require.NoError(t, k.Write(metrics[1:2]))
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{})
+
+	require.NoError(t, k.Write(metrics[2:3]))
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
+		},
+	})
+	assert.Empty(k.buffer)
+}
+
+func TestWrite_MaxBufferAge(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName:    streamName,
+		MinFlushBytes: internal.Size{Size: 1024 * 1024},
+		MaxBufferAge:  internal.Duration{Duration: time.Minute},
+		serializer:    serializer,
+		svc:           svc,
+	}
+	require.NoError(t, k.Init())
+
+	require.NoError(t, k.Write(metrics[0:1]))
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{})
 
-	elapsed := k.writeKinesis(records)
-	assert.GreaterOrEqual(elapsed.Nanoseconds(), zero)
+	// pretend the buffered record has been held past max_buffer_age
+	k.bufferStart = time.Now().Add(-2 * time.Minute)
 
+	require.NoError(t, k.Write(metrics[1:2]))
 	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
 		{
 			StreamName: &streamName,
-			Records:    records,
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
 		},
 	})
 }
 
-func TestWriteKinesis_WhenRecordErrors(t *testing.T) {
+func TestWrite_FlushMetricCount(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentEncoding string
+		records         int
+	}{
+		{
+			name:            "identity",
+			contentEncoding: "identity",
+			records:         3,
+		},
+		{
+			// each write packs its metrics into a single record, and the
+			// buffer holds two records with three metrics between them
+			name:            "gzip",
+			contentEncoding: "gzip",
+			records:         2,
+		},
+	}
 
-	assert := assert.New(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+			metrics, _ := createTestMetrics(t, 3, serializer)
 
-	errorCode := "InternalFailure"
-	errorMessage := "Internal Service Failure"
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(uint32(tt.records), 0)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:       "stream",
+				ContentEncoding:  tt.contentEncoding,
+				MinFlushBytes:    internal.Size{Size: 1024 * 1024},
+				FlushMetricCount: 3,
+				serializer:       serializer,
+				svc:              svc,
+			}
+			require.NoError(t, k.Init())
+
+			require.NoError(t, k.Write(metrics[0:2]))
+			require.Empty(t, svc.requests)
+
+			require.NoError(t, k.Write(metrics[2:3]))
+			require.Len(t, svc.requests, 1)
+			require.Len(t, svc.requests[0].Records, tt.records)
+			require.Empty(t, k.buffer)
+		})
+	}
+}
+
+func TestWrite_BufferWALReplay(t *testing.T) {
+	assert := assert.New(t)
+	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
 	streamName := "stream"
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
 
-	records := []*kinesis.PutRecordsRequestEntry{
-		{
-			PartitionKey: &partitionKey,
-			Data:         []byte{0x66},
-		},
-	}
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
 
-	svc := &mockKinesisPutRecords{}
-	svc.SetupResponse(
-		1,
-		[]*kinesis.PutRecordsResultEntry{
-			{
-				ErrorCode:      &errorCode,
-				ErrorMessage:   &errorMessage,
-				SequenceNumber: nil,
-				ShardId:        nil,
+	newOutput := func(svc *mockKinesisPutRecords) *KinesisOutput {
+		k := &KinesisOutput{
+			Log: testutil.Logger{},
+			Partition: &Partition{
+				Method: "static",
+				Key:    partitionKey,
 			},
-		},
-	)
-
-	k := KinesisOutput{
-		Log:        testutil.Logger{},
-		StreamName: streamName,
-		svc:        svc,
+			StreamName:    streamName,
+			MinFlushBytes: internal.Size{Size: 1024 * 1024},
+			BufferWALFile: path,
+			serializer:    serializer,
+			svc:           svc,
+		}
+		require.NoError(t, k.Init())
+		require.NoError(t, k.openWAL())
+		return k
 	}
 
-	elapsed := k.writeKinesis(records)
-	assert.GreaterOrEqual(elapsed.Nanoseconds(), zero)
+	// the first output exits without closing, losing its in-memory buffer
+	crashed := newOutput(&mockKinesisPutRecords{})
+	require.NoError(t, crashed.Write(metrics))
+	require.NoError(t, crashed.wal.close())
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
 
+	k := newOutput(svc)
+	assert.Len(k.buffer, 2)
+	require.NoError(t, k.Close())
 	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
 		{
 			StreamName: &streamName,
-			Records:    records,
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
 		},
 	})
-}
 
-func TestWriteKinesis_WhenServiceError(t *testing.T) {
+	// sent records are removed from the log
+	k = newOutput(&mockKinesisPutRecords{})
+	assert.Empty(k.buffer)
+	require.NoError(t, k.Close())
+}
 
+func TestWrite_BufferWALKeepsFailedRequest(t *testing.T) {
 	assert := assert.New(t)
-
+	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
-	streamName := "stream"
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
 
-	records := []*kinesis.PutRecordsRequestEntry{
-		{
-			PartitionKey: &partitionKey,
-			Data:         []byte{},
-		},
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+
+	newOutput := func(svc *mockKinesisPutRecords) *KinesisOutput {
+		k := &KinesisOutput{
+			Log: testutil.Logger{},
+			Partition: &Partition{
+				Method: "static",
+				Key:    partitionKey,
+			},
+			StreamName:    "stream",
+			MinFlushBytes: internal.Size{Size: 1},
+			BufferWALFile: path,
+			serializer:    serializer,
+			svc:           svc,
+		}
+		require.NoError(t, k.Init())
+		require.NoError(t, k.openWAL())
+		return k
 	}
 
 	svc := &mockKinesisPutRecords{}
-	svc.SetupErrorResponse(
-		awserr.New("InvalidArgumentException", "Invalid record", nil),
-	)
-
-	k := KinesisOutput{
-		Log:        testutil.Logger{},
-		StreamName: streamName,
-		svc:        svc,
-	}
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "internal failure", nil))
+
+	// the failed records are put back in the buffer, and the output exits
+	// without closing
+	crashed := newOutput(svc)
+	require.NoError(t, crashed.Write(metrics))
+	assert.Len(svc.requests, 1)
+	assert.Len(crashed.buffer, 2)
+	require.NoError(t, crashed.wal.close())
+
+	k := newOutput(&mockKinesisPutRecords{})
+	assert.Equal(createPutRecordsRequestEntries(metricsData, &partitionKey), k.buffer)
+	require.NoError(t, k.wal.close())
+}
 
-	elapsed := k.writeKinesis(records)
-	assert.GreaterOrEqual(elapsed.Nanoseconds(), zero)
+func TestWrite_BufferWALLimitsFailedRecords(t *testing.T) {
+	serializer := influx.NewSerializer()
+	partitionKey := "partitionKey"
 
-	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
-		{
-			StreamName: &streamName,
-			Records:    records,
-		},
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+	// room for three records in the log
+	entry := encodeWALEntry(&kinesis.PutRecordsRequestEntry{
+		Data:         metricsData[0],
+		PartitionKey: &partitionKey,
 	})
-}
+	maxSize := 3 * int64(len(entry))
 
-func TestWrite_NoMetrics(t *testing.T) {
-	assert := assert.New(t)
-	serializer := influx.NewSerializer()
 	svc := &mockKinesisPutRecords{}
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "internal failure", nil))
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "internal failure", nil))
 
-	k := KinesisOutput{
+	k := &KinesisOutput{
 		Log: testutil.Logger{},
 		Partition: &Partition{
 			Method: "static",
-			Key:    "partitionKey",
+			Key:    partitionKey,
 		},
-		StreamName: "stream",
-		serializer: serializer,
-		svc:        svc,
+		StreamName:       "stream",
+		MinFlushBytes:    internal.Size{Size: 1},
+		BufferWALFile:    filepath.Join(t.TempDir(), "kinesis.wal"),
+		BufferWALMaxSize: internal.Size{Size: maxSize},
+		serializer:       serializer,
+		svc:              svc,
 	}
+	require.NoError(t, k.Init())
+	require.NoError(t, k.openWAL())
+	defer k.wal.close()
+	dropped := k.walDropped.Get()
+
+	// the failed records fit in the buffer and are retried
+	require.NoError(t, k.Write(metrics))
+	require.Len(t, k.buffer, 2)
+	require.Equal(t, dropped, k.walDropped.Get())
+
+	// while the stream keeps failing, the backlog would outgrow the limit
+	require.NoError(t, k.Write(metrics))
+	require.Len(t, svc.requests, 2)
+	require.Len(t, svc.requests[1].Records, 4)
+	require.Empty(t, k.buffer)
+	require.Equal(t, dropped+4, k.walDropped.Get())
+}
 
-	err := k.Write([]telegraf.Metric{})
-	assert.Nil(err, "Should not return error")
-
-	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{})
+func TestInit_BufferWALRequiresBuffering(t *testing.T) {
+	k := KinesisOutput{
+		Log:           testutil.Logger{},
+		BufferWALFile: "kinesis.wal",
+	}
+	require.Error(t, k.Init())
 }
 
-func TestWrite_SingleMetric(t *testing.T) {
+func TestFlushBufferPeriodically(t *testing.T) {
 	assert := assert.New(t)
 	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
 	streamName := "stream"
 
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(1, 0)
+	svc.SetupGenericResponse(2, 0)
 
 	k := KinesisOutput{
 		Log: testutil.Logger{},
@@ -268,36 +2359,53 @@ func TestWrite_SingleMetric(t *testing.T) {
 			Method: "static",
 			Key:    partitionKey,
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		StreamName:    streamName,
+		MinFlushBytes: internal.Size{Size: 1024 * 1024},
+		serializer:    serializer,
+		svc:           svc,
 	}
+	require.NoError(t, k.Init())
 
-	metric, metricData := createTestMetric(t, "metric1", serializer)
-	err := k.Write([]telegraf.Metric{metric})
-	assert.Nil(err, "Should not return error")
+	ticks := make(chan time.Time)
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.flushBufferPeriodically(ticks)
+	}()
 
+	// an empty buffer does not produce a request
+	ticks <- time.Now()
+
+	require.NoError(t, k.Write(metrics))
+
+	// the second tick is only received once the first flush has completed
+	ticks <- time.Now()
+	ticks <- time.Now()
+
+	require.NoError(t, k.Close())
 	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
 		{
 			StreamName: &streamName,
-			Records: []*kinesis.PutRecordsRequestEntry{
-				{
-					PartitionKey: &partitionKey,
-					Data:         metricData,
-				},
-			},
+			Records: createPutRecordsRequestEntries(
+				metricsData,
+				&partitionKey,
+			),
 		},
 	})
 }
 
-func TestWrite_MultipleMetrics_SinglePartialRequest(t *testing.T) {
+func TestHeartbeatPeriodically(t *testing.T) {
 	assert := assert.New(t)
 	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
+	heartbeatKey := "heartbeat"
 	streamName := "stream"
 
+	metrics, metricsData := createTestMetrics(t, 1, serializer)
+
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(3, 0)
+	svc.SetupGenericResponse(1, 0)
+	svc.SetupGenericResponse(1, 0)
 
 	k := KinesisOutput{
 		Log: testutil.Logger{},
@@ -305,14 +2413,39 @@ func TestWrite_MultipleMetrics_SinglePartialRequest(t *testing.T) {
 			Method: "static",
 			Key:    partitionKey,
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		StreamName:            streamName,
+		HeartbeatInterval:     internal.Duration{Duration: time.Minute},
+		HeartbeatPartitionKey: heartbeatKey,
+		serializer:            serializer,
+		svc:                   svc,
 	}
-
-	metrics, metricsData := createTestMetrics(t, 3, serializer)
-	err := k.Write(metrics)
-	assert.Nil(err, "Should not return error")
+	require.NoError(t, k.Init())
+
+	ticks := make(chan time.Time)
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.heartbeatPeriodically(ticks)
+	}()
+
+	require.NoError(t, k.Write(metrics))
+
+	// records were sent during the first interval
+	ticks <- time.Unix(60, 0)
+	// nothing was sent during the second interval
+	heartbeatTime := time.Unix(120, 0)
+	ticks <- heartbeatTime
+
+	require.NoError(t, k.Close())
+
+	heartbeat := testutil.MustMetric(
+		"kinesis_heartbeat",
+		map[string]string{},
+		map[string]interface{}{"alive": true},
+		heartbeatTime,
+	)
+	heartbeatData, err := serializer.Serialize(heartbeat)
+	require.NoError(t, err)
 
 	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
 		{
@@ -322,17 +2455,26 @@ func TestWrite_MultipleMetrics_SinglePartialRequest(t *testing.T) {
 				&partitionKey,
 			),
 		},
+		{
+			StreamName: &streamName,
+			Records: createPutRecordsRequestEntries(
+				[][]byte{heartbeatData},
+				&heartbeatKey,
+			),
+		},
 	})
 }
 
-func TestWrite_MultipleMetrics_SingleFullRequest(t *testing.T) {
+func TestClose_DrainsBuffer(t *testing.T) {
 	assert := assert.New(t)
 	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
 	streamName := "stream"
 
+	metrics, metricsData := createTestMetrics(t, 2, serializer)
+
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+	svc.SetupGenericResponse(2, 0)
 
 	k := KinesisOutput{
 		Log: testutil.Logger{},
@@ -340,15 +2482,17 @@ func TestWrite_MultipleMetrics_SingleFullRequest(t *testing.T) {
 			Method: "static",
 			Key:    partitionKey,
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		StreamName:    streamName,
+		MinFlushBytes: internal.Size{Size: 1024 * 1024},
+		serializer:    serializer,
+		svc:           svc,
 	}
+	require.NoError(t, k.Init())
 
-	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest, serializer)
-	err := k.Write(metrics)
-	assert.Nil(err, "Should not return error")
+	require.NoError(t, k.Write(metrics))
+	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{})
 
+	require.NoError(t, k.Close())
 	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
 		{
 			StreamName: &streamName,
@@ -360,146 +2504,576 @@ func TestWrite_MultipleMetrics_SingleFullRequest(t *testing.T) {
 	})
 }
 
-func TestWrite_MultipleMetrics_MultipleRequests(t *testing.T) {
+func TestWrite_CircuitBreaker(t *testing.T) {
 	assert := assert.New(t)
 	serializer := influx.NewSerializer()
-	partitionKey := "partitionKey"
-	streamName := "stream"
+	partitionKey := "partitionKey"
+	streamName := "stream"
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupErrorResponse(awserr.New("InternalFailure", "Internal Service Failure", nil))
+	svc.SetupGenericResponse(0, 1)
+	svc.SetupGenericResponse(1, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    partitionKey,
+		},
+		StreamName:              streamName,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  internal.Duration{Duration: time.Hour},
+		serializer:              serializer,
+		svc:                     svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, _ := createTestMetrics(t, 1, serializer)
+
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics))
+	assert.Equal(circuitOpen, k.breaker.state)
+
+	// open breaker fails fast without calling Kinesis
+	require.Equal(t, errCircuitOpen, k.Write(metrics))
+	assert.Equal(2, len(svc.requests))
+
+	// after the cooldown a probe is allowed and closes the breaker
+	k.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, k.Write(metrics))
+	assert.Equal(3, len(svc.requests))
+	assert.Equal(circuitClosed, k.breaker.state)
+}
+
+func TestWrite_ReturnErrorsOnDrop(t *testing.T) {
+	tests := []struct {
+		name               string
+		returnErrorsOnDrop bool
+		successful         uint32
+		failed             uint32
+		invalid            bool
+		stale              bool
+		expected           string
+	}{
+		{
+			name:       "default ignores failures",
+			successful: 1,
+			failed:     1,
+			invalid:    true,
+		},
+		{
+			name:               "all sent",
+			returnErrorsOnDrop: true,
+			successful:         2,
+		},
+		{
+			name:               "failed records",
+			returnErrorsOnDrop: true,
+			successful:         1,
+			failed:             1,
+			expected:           "failed to write 1 of 2 record(s) and dropped 0 of 2 metric(s)",
+		},
+		{
+			name:               "dropped metrics",
+			returnErrorsOnDrop: true,
+			successful:         2,
+			invalid:            true,
+			expected:           "failed to write 0 of 2 record(s) and dropped 1 of 3 metric(s)",
+		},
+		{
+			name:               "stale metrics",
+			returnErrorsOnDrop: true,
+			successful:         2,
+			stale:              true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(tt.successful, tt.failed)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:         "stream",
+				ReturnErrorsOnDrop: tt.returnErrorsOnDrop,
+				serializer:         serializer,
+				svc:                svc,
+			}
+			require.NoError(t, k.Init())
+
+			metric1, _ := createTestMetric(t, "metric1", serializer)
+			metric2, _ := createTestMetric(t, "metric2", serializer)
+			metrics := []telegraf.Metric{metric1, metric2}
+			if tt.invalid {
+				// metric is invalid because of empty name
+				metrics = append(metrics, testutil.TestMetric(3, ""))
+			}
+			if tt.stale {
+				k.MaxMetricAge = internal.Duration{Duration: time.Hour}
+				metrics = []telegraf.Metric{
+					testutil.MustMetric("fresh1", map[string]string{}, map[string]interface{}{"value": 1}, time.Now()),
+					testutil.MustMetric("fresh2", map[string]string{}, map[string]interface{}{"value": 2}, time.Now()),
+					testutil.MustMetric("stale", map[string]string{}, map[string]interface{}{"value": 3}, time.Unix(0, 0)),
+				}
+			}
+
+			err := k.Write(metrics)
+			if tt.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrite_Strict(t *testing.T) {
+	serializer := &emptySerializer{
+		Serializer: influx.NewSerializer(),
+		emptyOn:    "filtered",
+	}
+	metric1, _ := createTestMetric(t, "metric1", serializer)
+	metric2, _ := createTestMetric(t, "metric2", serializer)
+
+	// hex encoded random data compresses to about half its size
+	random := make([]byte, 3*maxRecordSize/2)
+	rand.New(rand.NewSource(1)).Read(random)
+	oversized := testutil.MustMetric("oversized",
+		map[string]string{},
+		map[string]interface{}{"value": hex.EncodeToString(random)},
+		time.Now(),
+	)
+
+	tests := []struct {
+		name            string
+		metrics         []telegraf.Metric
+		contentEncoding string
+		maxMetricAge    time.Duration
+		successful      uint32
+		failed          uint32
+		requests        int
+		expected        string
+	}{
+		{
+			name:       "all sent",
+			metrics:    []telegraf.Metric{metric1, metric2},
+			successful: 2,
+			requests:   1,
+		},
+		{
+			name: "serialize error",
+			// metric is invalid because of empty name
+			metrics:  []telegraf.Metric{metric1, testutil.TestMetric(3, ""), metric2},
+			expected: "dropped 1 of 3 metric(s), not writing to Kinesis in strict mode",
+		},
+		{
+			name:            "oversized metric",
+			metrics:         []telegraf.Metric{metric1, oversized},
+			contentEncoding: "gzip",
+			expected:        "dropped 1 of 2 metric(s), not writing to Kinesis in strict mode",
+		},
+		{
+			name:       "failed records",
+			metrics:    []telegraf.Metric{metric1, metric2},
+			successful: 1,
+			failed:     1,
+			requests:   1,
+			expected:   "failed to write 1 of 2 record(s) in strict mode",
+		},
+		{
+			name: "stale metrics",
+			metrics: []telegraf.Metric{
+				testutil.MustMetric("fresh", map[string]string{}, map[string]interface{}{"value": 1}, time.Now()),
+				testutil.MustMetric("stale", map[string]string{}, map[string]interface{}{"value": 1}, time.Unix(0, 0)),
+			},
+			maxMetricAge: time.Hour,
+			successful:   1,
+			requests:     1,
+		},
+		{
+			name:       "empty serialized output",
+			metrics:    []telegraf.Metric{metric1, testutil.TestMetric(2, "filtered")},
+			successful: 1,
+			requests:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockKinesisPutRecords{}
+			svc.SetupGenericResponse(tt.successful, tt.failed)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:      "stream",
+				Strict:          true,
+				ContentEncoding: tt.contentEncoding,
+				MaxMetricAge:    internal.Duration{Duration: tt.maxMetricAge},
+				serializer:      serializer,
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+
+			err := k.Write(tt.metrics)
+			if tt.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expected)
+			}
+			// nothing is sent when metrics are dropped before sending
+			require.Len(t, svc.requests, tt.requests)
+		})
+	}
+}
+
+func TestWrite_RetryOnThrottle(t *testing.T) {
+	throttledRecord := &kinesis.PutRecordsResultEntry{
+		ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+		ErrorMessage: aws.String("Rate exceeded for shard shardId-000000000001"),
+	}
+	sentRecord := &kinesis.PutRecordsResultEntry{
+		SequenceNumber: aws.String("1"),
+		ShardId:        aws.String("shardId-000000000001"),
+	}
+
+	tests := []struct {
+		name            string
+		retryOnThrottle bool
+		setup           func(svc *mockKinesisPutRecords)
+		expected        string
+	}{
+		{
+			name:            "throttled records",
+			retryOnThrottle: true,
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupResponse(1, []*kinesis.PutRecordsResultEntry{sentRecord, throttledRecord})
+			},
+			expected: "1 of 2 record(s) were throttled by Kinesis, retrying on the next flush",
+		},
+		{
+			name:            "throttled request",
+			retryOnThrottle: true,
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupErrorResponse(awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil))
+			},
+			expected: "2 of 2 record(s) were throttled by Kinesis, retrying on the next flush",
+		},
+		{
+			name:            "other failures",
+			retryOnThrottle: true,
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupGenericResponse(1, 1)
+			},
+		},
+		{
+			name: "disabled",
+			setup: func(svc *mockKinesisPutRecords) {
+				svc.SetupResponse(1, []*kinesis.PutRecordsResultEntry{sentRecord, throttledRecord})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serializer := influx.NewSerializer()
+
+			svc := &mockKinesisPutRecords{}
+			tt.setup(svc)
+
+			k := KinesisOutput{
+				Log: testutil.Logger{},
+				Partition: &Partition{
+					Method: "static",
+					Key:    "partitionKey",
+				},
+				StreamName:      "stream",
+				RetryOnThrottle: tt.retryOnThrottle,
+				serializer:      serializer,
+				svc:             svc,
+			}
+			require.NoError(t, k.Init())
+
+			metrics, _ := createTestMetrics(t, 2, serializer)
+			err := k.Write(metrics)
+			if tt.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrite_RetryOnThrottle_Timeout(t *testing.T) {
+	serializer := influx.NewSerializer()
+
+	svc := &mockKinesisPutRecords{}
+	svc.SetupHangingResponse()
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "partitionKey",
+		},
+		StreamName:        "stream",
+		PutRecordsTimeout: internal.Duration{Duration: 10 * time.Millisecond},
+		RetryOnThrottle:   true,
+		serializer:        serializer,
+		svc:               svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, _ := createTestMetrics(t, 2, serializer)
+	require.EqualError(t, k.Write(metrics),
+		"0 of 2 record(s) were throttled by Kinesis and 2 timed out, retrying on the next flush")
+}
+
+func TestWrite_RetryOnThrottle_Sustained(t *testing.T) {
+	serializer := influx.NewSerializer()
 
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+	for i := 0; i < 3; i++ {
+		svc.SetupErrorResponse(awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "Rate exceeded", nil))
+	}
 	svc.SetupGenericResponse(1, 0)
 
 	k := KinesisOutput{
 		Log: testutil.Logger{},
 		Partition: &Partition{
 			Method: "static",
-			Key:    partitionKey,
+			Key:    "partitionKey",
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		StreamName:      "stream",
+		RetryOnThrottle: true,
+		serializer:      serializer,
+		svc:             svc,
 	}
+	require.NoError(t, k.Init())
 
-	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest+1, serializer)
-	err := k.Write(metrics)
-	assert.Nil(err, "Should not return error")
+	// the agent retries the same metrics on every flush until the stream
+	// stops throttling
+	metrics, _ := createTestMetrics(t, 1, serializer)
+	for i := 0; i < 3; i++ {
+		require.Error(t, k.Write(metrics))
+	}
+	require.NoError(t, k.Write(metrics))
+	require.Len(t, svc.requests, 4)
+}
 
-	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
-		{
-			StreamName: &streamName,
-			Records: createPutRecordsRequestEntries(
-				metricsData[0:maxRecordsPerRequest],
-				&partitionKey,
-			),
-		},
-		{
-			StreamName: &streamName,
-			Records: createPutRecordsRequestEntries(
-				metricsData[maxRecordsPerRequest:],
-				&partitionKey,
-			),
+func TestWrite_ReshuffleFailedOnRetry(t *testing.T) {
+	throttledRecord := &kinesis.PutRecordsResultEntry{
+		ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+		ErrorMessage: aws.String("Rate exceeded for shard shardId-000000000001"),
+	}
+
+	serializer := influx.NewSerializer()
+	svc := &mockKinesisPutRecords{}
+	svc.SetupResponse(2, []*kinesis.PutRecordsResultEntry{throttledRecord, throttledRecord})
+	svc.SetupGenericResponse(2, 0)
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log: testutil.Logger{},
+		Partition: &Partition{
+			Method: "static",
+			Key:    "hot",
 		},
-	})
+		StreamName:             "stream",
+		RetryOnThrottle:        true,
+		ReshuffleFailedOnRetry: true,
+		serializer:             serializer,
+		svc:                    svc,
+	}
+	require.NoError(t, k.Init())
+
+	metrics, _ := createTestMetrics(t, 2, serializer)
+	require.Error(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics))
+	require.Len(t, svc.requests, 3)
+
+	keys := func(request *kinesis.PutRecordsInput) []string {
+		var keys []string
+		for _, record := range request.Records {
+			keys = append(keys, aws.StringValue(record.PartitionKey))
+		}
+		return keys
+	}
+	require.Equal(t, []string{"hot", "hot"}, keys(svc.requests[0]))
+
+	// the retry is spread with random keys
+	retried := keys(svc.requests[1])
+	require.NotContains(t, retried, "hot")
+	require.NotEqual(t, retried[0], retried[1])
+
+	// the configured key is used again once it is no longer throttled
+	require.Equal(t, []string{"hot", "hot"}, keys(svc.requests[2]))
 }
 
-func TestWrite_MultipleMetrics_MultipleFullRequests(t *testing.T) {
-	assert := assert.New(t)
-	serializer := influx.NewSerializer()
-	partitionKey := "partitionKey"
-	streamName := "stream"
+func TestWrite_ReshuffleFailedOnRetryKeepsPrefix(t *testing.T) {
+	throttledRecord := &kinesis.PutRecordsResultEntry{
+		ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+		ErrorMessage: aws.String("Rate exceeded for shard shardId-000000000001"),
+	}
 
+	serializer := influx.NewSerializer()
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
-	svc.SetupGenericResponse(maxRecordsPerRequest, 0)
+	svc.SetupResponse(2, []*kinesis.PutRecordsResultEntry{throttledRecord, throttledRecord})
+	svc.SetupGenericResponse(2, 0)
 
 	k := KinesisOutput{
 		Log: testutil.Logger{},
 		Partition: &Partition{
 			Method: "static",
-			Key:    partitionKey,
+			Key:    "hot",
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		PartitionKeyPrefix:     "prod/",
+		StreamName:             "stream",
+		RetryOnThrottle:        true,
+		ReshuffleFailedOnRetry: true,
+		serializer:             serializer,
+		svc:                    svc,
 	}
+	require.NoError(t, k.Init())
 
-	metrics, metricsData := createTestMetrics(t, maxRecordsPerRequest*2, serializer)
-	err := k.Write(metrics)
-	assert.Nil(err, "Should not return error")
+	metrics, _ := createTestMetrics(t, 2, serializer)
+	require.Error(t, k.Write(metrics))
+	require.NoError(t, k.Write(metrics))
+	require.Len(t, svc.requests, 2)
 
-	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
-		{
-			StreamName: &streamName,
-			Records: createPutRecordsRequestEntries(
-				metricsData[0:maxRecordsPerRequest],
-				&partitionKey,
-			),
-		},
-		{
-			StreamName: &streamName,
-			Records: createPutRecordsRequestEntries(
-				metricsData[maxRecordsPerRequest:],
-				&partitionKey,
-			),
-		},
-	})
+	for _, record := range svc.requests[0].Records {
+		require.Equal(t, "prod/hot", aws.StringValue(record.PartitionKey))
+	}
+
+	// the random keys of the retry keep the prefix
+	for _, record := range svc.requests[1].Records {
+		key := aws.StringValue(record.PartitionKey)
+		require.True(t, strings.HasPrefix(key, "prod/"), key)
+		require.NotEqual(t, "prod/hot", key)
+	}
 }
 
-func TestWrite_SerializerError(t *testing.T) {
-	assert := assert.New(t)
+func TestInit_ReshuffleRequiresRetryOnThrottle(t *testing.T) {
+	k := KinesisOutput{
+		Log:                    testutil.Logger{},
+		ReshuffleFailedOnRetry: true,
+	}
+	require.EqualError(t, k.Init(), "reshuffle_failed_on_retry requires retry_on_throttle to be set")
+}
+
+func TestWrite_LogFlushSummary(t *testing.T) {
 	serializer := influx.NewSerializer()
 	partitionKey := "partitionKey"
-	streamName := "stream"
 
 	svc := &mockKinesisPutRecords{}
-	svc.SetupGenericResponse(2, 0)
+	svc.SetupErrorResponse(
+		awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil),
+	)
+	svc.SetupGenericResponse(1, 1)
 
+	provider := &countingCredentialsProvider{}
+	creds := credentials.NewCredentials(provider)
+	_, err := creds.Get()
+	require.NoError(t, err)
+
+	log := &recordingLogger{}
 	k := KinesisOutput{
-		Log: testutil.Logger{},
+		Log: log,
 		Partition: &Partition{
 			Method: "static",
 			Key:    partitionKey,
 		},
-		StreamName: streamName,
-		serializer: serializer,
-		svc:        svc,
+		StreamName:      "stream",
+		LogFlushSummary: true,
+		serializer:      serializer,
+		svc:             svc,
+		credentials:     creds,
 	}
+	require.NoError(t, k.Init())
 
 	metric1, metric1Data := createTestMetric(t, "metric1", serializer)
-	metric2, metric2Data := createTestMetric(t, "metric2", serializer)
+	metric2, _ := createTestMetric(t, "metric2", serializer)
 
 	// metric is invalid because of empty name
 	invalidMetric := testutil.TestMetric(3, "")
 
-	err := k.Write([]telegraf.Metric{
-		metric1,
-		invalidMetric,
-		metric2,
-	})
-	assert.Nil(err, "Should not return error")
+	require.NoError(t, k.Write([]telegraf.Metric{metric1, invalidMetric, metric2}))
 
-	// remaining valid metrics should still get written
-	svc.AssertRequests(assert, []*kinesis.PutRecordsInput{
-		{
-			StreamName: &streamName,
-			Records: []*kinesis.PutRecordsRequestEntry{
-				{
-					PartitionKey: &partitionKey,
-					Data:         metric1Data,
-				},
-				{
-					PartitionKey: &partitionKey,
-					Data:         metric2Data,
-				},
-			},
-		},
-	})
+	messages := log.Messages("I!")
+	require.Len(t, messages, 1)
+	expected := fmt.Sprintf(
+		"Flushed 3 metric(s) as 2 record(s): sent 2 record(s) in 2 request(s) with 1 failed and 1 retried, %d byte(s) in ",
+		len(metric1Data)+len(partitionKey),
+	)
+	require.True(t, strings.HasPrefix(messages[0], expected), messages[0])
+}
+
+func TestInit_InvalidSerializeErrorBehavior(t *testing.T) {
+	k := KinesisOutput{
+		Log:                    testutil.Logger{},
+		SerializeErrorBehavior: "explode",
+	}
+	require.Error(t, k.Init())
+}
+
+type failingSerializer struct {
+	serializers.Serializer
+	failOn string
+}
+
+func (s *failingSerializer) Serialize(metric telegraf.Metric) ([]byte, error) {
+	if metric.Name() == s.failOn {
+		return nil, fmt.Errorf("unable to serialize %q", metric.Name())
+	}
+	return s.Serializer.Serialize(metric)
+}
+
+type emptySerializer struct {
+	serializers.Serializer
+	emptyOn string
+}
+
+func (s *emptySerializer) Serialize(metric telegraf.Metric) ([]byte, error) {
+	if metric.Name() == s.emptyOn {
+		return []byte{}, nil
+	}
+	return s.Serializer.Serialize(metric)
+}
+
+type countingCredentialsProvider struct {
+	retrieved int
+}
+
+func (p *countingCredentialsProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		ProviderName:    "counting",
+	}, nil
+}
+
+func (p *countingCredentialsProvider) IsExpired() bool {
+	return false
 }
 
 type mockKinesisPutRecordsResponse struct {
 	Output *kinesis.PutRecordsOutput
 	Err    error
+	Hang   bool
 }
 
 type mockKinesisPutRecords struct {
@@ -560,16 +3134,37 @@ func (m *mockKinesisPutRecords) SetupErrorResponse(err error) {
 	})
 }
 
+// SetupHangingResponse queues a response that blocks until the request
+// context is done.
+func (m *mockKinesisPutRecords) SetupHangingResponse() {
+
+	m.responses = append(m.responses, &mockKinesisPutRecordsResponse{
+		Hang: true,
+	})
+}
+
 func (m *mockKinesisPutRecords) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	return m.PutRecordsWithContext(context.Background(), input)
+}
+
+func (m *mockKinesisPutRecords) PutRecordsWithContext(
+	ctx aws.Context,
+	input *kinesis.PutRecordsInput,
+	_ ...request.Option,
+) (*kinesis.PutRecordsOutput, error) {
 
 	reqNum := len(m.requests)
-	if reqNum > len(m.responses) {
+	if reqNum >= len(m.responses) {
 		return nil, fmt.Errorf("Response for request %+v not setup", reqNum)
 	}
 
 	m.requests = append(m.requests, input)
 
 	resp := m.responses[reqNum]
+	if resp.Hang {
+		<-ctx.Done()
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
 	return resp.Output, resp.Err
 }
 
@@ -623,6 +3218,146 @@ func (m *mockKinesisPutRecords) AssertRequests(
 	}
 }
 
+type mockKinesisDescribeStreamSummary struct {
+	kinesisiface.KinesisAPI
+
+	sync.Mutex
+	requests  []*kinesis.DescribeStreamSummaryInput
+	responses []*mockKinesisDescribeStreamSummaryResponse
+}
+
+type mockKinesisDescribeStreamSummaryResponse struct {
+	Status         string
+	EncryptionType string
+	Err            error
+}
+
+// SetupResponse queues a stream status. Once all responses have been
+// returned the last one is repeated.
+func (m *mockKinesisDescribeStreamSummary) SetupResponse(status string) {
+	m.responses = append(m.responses, &mockKinesisDescribeStreamSummaryResponse{
+		Status: status,
+	})
+}
+
+// SetupEncryptionResponse queues an active stream with the given
+// encryption type.
+func (m *mockKinesisDescribeStreamSummary) SetupEncryptionResponse(encryptionType string) {
+	m.responses = append(m.responses, &mockKinesisDescribeStreamSummaryResponse{
+		Status:         kinesis.StreamStatusActive,
+		EncryptionType: encryptionType,
+	})
+}
+
+func (m *mockKinesisDescribeStreamSummary) SetupErrorResponse(err error) {
+	m.responses = append(m.responses, &mockKinesisDescribeStreamSummaryResponse{
+		Err: err,
+	})
+}
+
+func (m *mockKinesisDescribeStreamSummary) DescribeStreamSummary(
+	input *kinesis.DescribeStreamSummaryInput,
+) (*kinesis.DescribeStreamSummaryOutput, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	reqNum := len(m.requests)
+	m.requests = append(m.requests, input)
+
+	if len(m.responses) == 0 {
+		return nil, fmt.Errorf("Response for request %+v not setup", reqNum)
+	}
+	if reqNum >= len(m.responses) {
+		reqNum = len(m.responses) - 1
+	}
+
+	resp := m.responses[reqNum]
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+
+	summary := &kinesis.StreamDescriptionSummary{
+		StreamName:   input.StreamName,
+		StreamStatus: aws.String(resp.Status),
+	}
+	if resp.EncryptionType != "" {
+		summary.EncryptionType = aws.String(resp.EncryptionType)
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: summary,
+	}, nil
+}
+
+func (m *mockKinesisDescribeStreamSummary) RequestCount() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.requests)
+}
+
+// recordingLogger keeps logged messages so tests can assert on them.
+type recordingLogger struct {
+	sync.Mutex
+	entries []recordedLogEntry
+}
+
+type recordedLogEntry struct {
+	level   string
+	message string
+}
+
+func (l *recordingLogger) record(level string, message string) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, recordedLogEntry{level: level, message: message})
+}
+
+// Messages returns the messages logged at the given level, such as "W!".
+func (l *recordingLogger) Messages(level string) []string {
+	l.Lock()
+	defer l.Unlock()
+
+	messages := []string{}
+	for _, entry := range l.entries {
+		if entry.level == level {
+			messages = append(messages, entry.message)
+		}
+	}
+	return messages
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("E!", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Error(args ...interface{}) {
+	l.record("E!", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("D!", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debug(args ...interface{}) {
+	l.record("D!", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("W!", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warn(args ...interface{}) {
+	l.record("W!", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("I!", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Info(args ...interface{}) {
+	l.record("I!", fmt.Sprint(args...))
+}
+
 func createTestMetric(
 	t *testing.T,
 	name string,
@@ -673,3 +3408,147 @@ func createPutRecordsRequestEntries(
 
 	return records
 }
+
+func TestCreateRecords_SkipOversizedMetrics(t *testing.T) {
+	huge := testutil.MustMetric("huge",
+		map[string]string{},
+		map[string]interface{}{"value": strings.Repeat("a", maxRecordSize)},
+		time.Now(),
+	)
+	small := testutil.TestMetric(1, "small")
+
+	k := KinesisOutput{
+		Log:                  testutil.Logger{},
+		SkipOversizedMetrics: true,
+		serializer:           influx.NewSerializer(),
+	}
+	require.NoError(t, k.Init())
+
+	r, _, _, err := k.createRecords([]telegraf.Metric{small, huge, small})
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	// metrics that may fit once compressed are kept
+	k.ContentEncoding = "gzip"
+	r, _, _, err = k.createRecords([]telegraf.Metric{small, huge, small})
+	require.NoError(t, err)
+	require.Len(t, r, 3)
+}
+
+func TestCreateRecords_SkipOversizedMetricsUnboundedFormat(t *testing.T) {
+	// the graphite template leaves out the tag key, so the metric is
+	// serialized below the bound
+	metric := testutil.MustMetric("cpu",
+		map[string]string{strings.Repeat("k", maxRecordSize): "host"},
+		map[string]interface{}{"value": 1},
+		time.Now(),
+	)
+
+	k := KinesisOutput{
+		Log:                  testutil.Logger{},
+		SkipOversizedMetrics: true,
+		serializer:           &graphite.GraphiteSerializer{},
+	}
+	require.NoError(t, k.Init())
+
+	r, _, _, err := k.createRecords([]telegraf.Metric{metric})
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Less(t, len(r[0].Data), maxRecordSize)
+}
+
+func TestCreateRecords_SkipOversizedMetricsStringFields(t *testing.T) {
+	// the prometheus serializer leaves out string fields, so the metric is
+	// serialized below the record limit
+	metric := testutil.MustMetric("cpu",
+		map[string]string{},
+		map[string]interface{}{"value": 1, "message": strings.Repeat("a", maxRecordSize)},
+		time.Now(),
+	)
+
+	serializer, err := prometheus.NewSerializer(prometheus.FormatConfig{})
+	require.NoError(t, err)
+
+	k := KinesisOutput{
+		Log:                  testutil.Logger{},
+		SkipOversizedMetrics: true,
+		serializer:           serializer,
+	}
+	require.NoError(t, k.Init())
+
+	r, _, _, err := k.createRecords([]telegraf.Metric{metric})
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Less(t, len(r[0].Data), maxRecordSize)
+}
+
+func TestMinSerializedSize(t *testing.T) {
+	serializer := influx.NewSerializer()
+	for _, metric := range []telegraf.Metric{
+		testutil.TestMetric(1, "cpu"),
+		testutil.MustMetric("mem",
+			map[string]string{"host": "server01", "region": "eu-west-1"},
+			map[string]interface{}{"used": 1.5, "name": "value", "ok": true},
+			time.Now(),
+		),
+	} {
+		data, err := serializer.Serialize(metric)
+		require.NoError(t, err)
+		require.Less(t, minSerializedSize(metric, true), len(data))
+	}
+}
+
+func TestCreateRecords_MeasurementRename(t *testing.T) {
+	cpu := testutil.TestMetric(1, "cpu")
+	mem := testutil.TestMetric(2, "mem")
+
+	k := KinesisOutput{
+		Log:               testutil.Logger{},
+		Partition:         &Partition{Method: "measurement"},
+		MeasurementRename: map[string]string{"cpu": "prod.cpu"},
+		serializer:        influx.NewSerializer(),
+	}
+	require.NoError(t, k.Init())
+
+	r, _, _, err := k.createRecords([]telegraf.Metric{cpu, mem})
+	require.NoError(t, err)
+	require.Len(t, r, 2)
+
+	require.Equal(t, "prod.cpu", aws.StringValue(r[0].PartitionKey))
+	require.True(t, bytes.HasPrefix(r[0].Data, []byte("prod.cpu,")))
+	require.Equal(t, "mem", aws.StringValue(r[1].PartitionKey))
+
+	// the metric in the agent buffer is unchanged
+	require.Equal(t, "cpu", cpu.Name())
+}
+
+func BenchmarkCreateRecords_OversizedMetrics(b *testing.B) {
+	// one huge metric in every hundred
+	metrics := []telegraf.Metric{}
+	for i := 0; i < 99; i++ {
+		metrics = append(metrics, testutil.TestMetric(i, "small"))
+	}
+	metrics = append(metrics, testutil.MustMetric("huge",
+		map[string]string{},
+		map[string]interface{}{"value": strings.Repeat("a\\\"", maxRecordSize)},
+		time.Now(),
+	))
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip_oversized_metrics=%t", skip), func(b *testing.B) {
+			k := KinesisOutput{
+				Log:                  testutil.Logger{},
+				SkipOversizedMetrics: skip,
+				serializer:           influx.NewSerializer(),
+			}
+			require.NoError(b, k.Init())
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, _, _, err := k.createRecords(metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
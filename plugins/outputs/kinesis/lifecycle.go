@@ -0,0 +1,64 @@
+package kinesis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// Lifecycle events of the output, counted in the lifecycle_events internal
+// metric and logged when log_lifecycle_events is set.
+const (
+	eventConnected      = "connected"
+	eventConnectFailed  = "connect_failed"
+	eventStreamInactive = "stream_inactive"
+	eventStreamActive   = "stream_active"
+)
+
+var lifecycleEvents = []string{eventConnected, eventConnectFailed, eventStreamInactive, eventStreamActive}
+
+func (k *KinesisOutput) registerLifecycleEvents(tags map[string]string) {
+	k.events = map[string]selfstat.Stat{}
+	for _, event := range lifecycleEvents {
+		eventTags := map[string]string{"event": event}
+		for key, value := range tags {
+			eventTags[key] = value
+		}
+		k.events[event] = selfstat.Register("kinesis", "lifecycle_events", eventTags)
+	}
+}
+
+// emitEvent counts the event and, with log_lifecycle_events, logs it as
+// space separated key=value pairs so log pipelines can parse it. Events
+// other than a successful connection or a stream becoming active are logged
+// as warnings.
+func (k *KinesisOutput) emitEvent(event string, stream string, status string, err error) {
+	if stat, ok := k.events[event]; ok {
+		stat.Incr(1)
+	}
+	if !k.LogLifecycleEvents {
+		return
+	}
+
+	fields := []string{
+		"event=" + event,
+		"backend=" + k.Backend,
+		"region=" + k.Region,
+		fmt.Sprintf("stream=%q", stream),
+	}
+	if status != "" {
+		fields = append(fields, "status="+status)
+	}
+	if err != nil {
+		fields = append(fields, fmt.Sprintf("error=%q", err.Error()))
+	}
+	message := "Lifecycle " + strings.Join(fields, " ")
+
+	switch event {
+	case eventConnected, eventStreamActive:
+		k.Log.Info(message)
+	default:
+		k.Log.Warn(message)
+	}
+}
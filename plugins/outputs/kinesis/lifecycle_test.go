@@ -0,0 +1,84 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil/fakekinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnect_LifecycleEvents(t *testing.T) {
+	server := fakekinesis.NewServer()
+	defer server.Close()
+	server.AddStream("stream", 1)
+
+	log := &recordingLogger{}
+	k := newFakeKinesisOutput(t, server)
+	k.Log = log
+	k.LogLifecycleEvents = true
+
+	connected := k.events[eventConnected].Get()
+	require.NoError(t, k.Connect())
+	defer k.Close()
+
+	require.Equal(t, connected+1, k.events[eventConnected].Get())
+	require.Contains(t, log.Messages("I!"),
+		`Lifecycle event=connected backend=kinesis region=us-east-1 stream="stream" status=ACTIVE`)
+}
+
+func TestConnect_LifecycleEventsFailure(t *testing.T) {
+	server := fakekinesis.NewServer()
+	defer server.Close()
+
+	log := &recordingLogger{}
+	k := newFakeKinesisOutput(t, server)
+	k.Log = log
+	k.LogLifecycleEvents = true
+
+	failed := k.events[eventConnectFailed].Get()
+	connected := k.events[eventConnected].Get()
+	require.Error(t, k.Connect())
+
+	require.Equal(t, failed+1, k.events[eventConnectFailed].Get())
+	require.Equal(t, connected, k.events[eventConnected].Get())
+
+	messages := log.Messages("W!")
+	require.Len(t, messages, 1)
+	require.Contains(t, messages[0], `Lifecycle event=connect_failed backend=kinesis region=us-east-1 stream="stream" error=`)
+	require.Contains(t, messages[0], "ResourceNotFoundException")
+}
+
+func TestDescribeStream_LifecycleEvents(t *testing.T) {
+	svc := &mockKinesisDescribeStreamSummary{}
+	svc.SetupResponse(kinesis.StreamStatusActive)
+	svc.SetupResponse(kinesis.StreamStatusUpdating)
+	svc.SetupResponse(kinesis.StreamStatusUpdating)
+	svc.SetupResponse(kinesis.StreamStatusActive)
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:                log,
+		StreamName:         "lifecycle",
+		LogLifecycleEvents: true,
+		serializer:         influx.NewSerializer(),
+		svc:                svc,
+	}
+	require.NoError(t, k.Init())
+
+	inactive := k.events[eventStreamInactive].Get()
+	active := k.events[eventStreamActive].Get()
+	for i := 0; i < 4; i++ {
+		_, err := k.describeStream(k.StreamName)
+		require.NoError(t, err)
+	}
+
+	// the unchanged status is not reported twice
+	require.Equal(t, inactive+1, k.events[eventStreamInactive].Get())
+	require.Equal(t, active+1, k.events[eventStreamActive].Get())
+	require.Contains(t, log.Messages("W!"),
+		`Lifecycle event=stream_inactive backend=kinesis region= stream="lifecycle" status=UPDATING`)
+	require.Contains(t, log.Messages("I!"),
+		`Lifecycle event=stream_active backend=kinesis region= stream="lifecycle" status=ACTIVE`)
+}
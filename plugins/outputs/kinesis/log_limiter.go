@@ -0,0 +1,42 @@
+package kinesis
+
+import (
+	"sync"
+	"time"
+)
+
+// logLimiter collapses repeated log messages. A message is logged at most
+// once per window for each format, and the number of messages suppressed in
+// between is reported with the next one logged.
+type logLimiter struct {
+	sync.Mutex
+	window time.Duration
+
+	logged     map[string]time.Time
+	suppressed map[string]int
+}
+
+func newLogLimiter(window time.Duration) *logLimiter {
+	return &logLimiter{
+		window:     window,
+		logged:     map[string]time.Time{},
+		suppressed: map[string]int{},
+	}
+}
+
+// allow reports whether a message with the format may be logged, and if so
+// how many were suppressed since the last one.
+func (l *logLimiter) allow(format string, now time.Time) (bool, int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if last, ok := l.logged[format]; ok && now.Sub(last) < l.window {
+		l.suppressed[format]++
+		return false, 0
+	}
+
+	suppressed := l.suppressed[format]
+	l.logged[format] = now
+	delete(l.suppressed, format)
+	return true, suppressed
+}
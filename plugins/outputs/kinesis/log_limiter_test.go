@@ -0,0 +1,74 @@
+package kinesis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLimiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLogLimiter(time.Minute)
+
+	ok, suppressed := l.allow("a %d", now)
+	require.True(t, ok)
+	require.Zero(t, suppressed)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = l.allow("a %d", now.Add(time.Duration(i)*time.Second))
+		require.False(t, ok)
+	}
+
+	// other messages are limited separately
+	ok, _ = l.allow("b %d", now.Add(time.Second))
+	require.True(t, ok)
+
+	ok, suppressed = l.allow("a %d", now.Add(time.Minute))
+	require.True(t, ok)
+	require.Equal(t, 3, suppressed)
+
+	ok, suppressed = l.allow("a %d", now.Add(2*time.Minute))
+	require.True(t, ok)
+	require.Zero(t, suppressed)
+}
+
+func TestWriteKinesis_LogSuppression(t *testing.T) {
+	records := []*kinesis.PutRecordsRequestEntry{
+		{
+			PartitionKey: aws.String("partitionKey"),
+			Data:         []byte{0x65},
+		},
+	}
+
+	svc := &mockKinesisPutRecords{}
+	for i := 0; i < 50; i++ {
+		svc.SetupErrorResponse(errors.New("connection refused"))
+	}
+
+	log := &recordingLogger{}
+	k := KinesisOutput{
+		Log:                  log,
+		StreamName:           "stream",
+		LogSuppressionWindow: internal.Duration{Duration: time.Hour},
+		svc:                  svc,
+	}
+	require.NoError(t, k.Init())
+
+	for i := 0; i < 49; i++ {
+		k.writeKinesis(k.StreamName, records)
+	}
+	require.Equal(t, []string{"Unable to write to Kinesis : connection refused"}, log.Messages("E!"))
+
+	// once the window has passed the number of suppressed messages is logged
+	k.logLimiter.logged["Unable to write to Kinesis : %s"] = time.Now().Add(-time.Hour)
+	k.writeKinesis(k.StreamName, records)
+	require.Equal(t, []string{
+		"Unable to write to Kinesis : connection refused",
+		"Unable to write to Kinesis : connection refused (48 similar message(s) suppressed)",
+	}, log.Messages("E!"))
+}
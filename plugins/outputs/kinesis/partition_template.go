@@ -0,0 +1,58 @@
+package kinesis
+
+import (
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// templateMetric exposes a metric to the partition key template.
+type templateMetric struct {
+	metric telegraf.Metric
+}
+
+func (m *templateMetric) Name() string {
+	return m.metric.Name()
+}
+
+func (m *templateMetric) Tag(key string) string {
+	tag, _ := m.metric.GetTag(key)
+	return tag
+}
+
+func (m *templateMetric) Tags() map[string]string {
+	return m.metric.Tags()
+}
+
+func (m *templateMetric) Field(key string) interface{} {
+	field, _ := m.metric.GetField(key)
+	return field
+}
+
+func (m *templateMetric) Fields() map[string]interface{} {
+	return m.metric.Fields()
+}
+
+func (m *templateMetric) Time() time.Time {
+	return m.metric.Time()
+}
+
+// templatePartitionKey renders the partition key template for the metric,
+// falling back to the partition default when the result is empty. Long keys
+// are truncated to the Kinesis limit.
+func (k *KinesisOutput) templatePartitionKey(metric telegraf.Metric) string {
+	var b strings.Builder
+	if err := k.partitionTemplate.Execute(&b, &templateMetric{metric: metric}); err != nil {
+		k.Log.Debugf("Could not render partition key template for %q: %v", metric.Name(), err)
+		b.Reset()
+	}
+
+	if key := b.String(); key != "" {
+		return truncatePartitionKey(key)
+	}
+	if k.Partition != nil && len(k.Partition.Default) > 0 {
+		return k.Partition.Default
+	}
+	return "telegraf"
+}
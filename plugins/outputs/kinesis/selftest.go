@@ -0,0 +1,99 @@
+package kinesis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// Partition key used for the synthetic record sent by SelfTest.
+const healthCheckPartitionKey = "__telegraf_healthcheck__"
+
+// SelfTestResult describes the outcome of SelfTest.
+type SelfTestResult struct {
+	Region       string
+	Endpoint     string
+	StreamName   string
+	StreamStatus string
+	RecordSent   bool
+}
+
+// SelfTest connects to Kinesis and, unless dryRun is set, writes a single
+// synthetic record to the first stream using the healthcheck partition key. It is intended for
+// validating a configuration without running the agent. The caller is
+// responsible for calling Close.
+func (k *KinesisOutput) SelfTest(dryRun bool) (*SelfTestResult, error) {
+	if err := k.Connect(); err != nil {
+		stream := k.streamNames()[0]
+		return &SelfTestResult{
+			Region:     k.Region,
+			StreamName: stream,
+		}, fmt.Errorf("unable to connect to stream %q: %v", stream, err)
+	}
+
+	return k.selfTest(dryRun)
+}
+
+func (k *KinesisOutput) selfTest(dryRun bool) (*SelfTestResult, error) {
+	result := &SelfTestResult{
+		Region:       k.Region,
+		Endpoint:     k.endpoint,
+		StreamName:   k.streamNames()[0],
+		StreamStatus: k.getStreamStatus(),
+	}
+
+	if dryRun {
+		k.Log.Infof("Self test of stream %q in %s passed (dry run), stream status %s",
+			result.StreamName, result.Region, result.StreamStatus)
+		return result, nil
+	}
+
+	m, err := metric.New(
+		"kinesis_healthcheck",
+		map[string]string{},
+		map[string]interface{}{"ok": true},
+		time.Now(),
+	)
+	if err != nil {
+		return result, err
+	}
+
+	data, err := k.serialize(m)
+	if err != nil {
+		return result, fmt.Errorf("unable to serialize healthcheck metric: %v", err)
+	}
+
+	records, _, _ := k.encodeRecords([]*kinesis.PutRecordsRequestEntry{
+		{
+			Data:         data,
+			PartitionKey: aws.String(healthCheckPartitionKey),
+		},
+	})
+	if len(records) != 1 {
+		return result, fmt.Errorf("unable to encode healthcheck record")
+	}
+
+	resp, err := k.svc.PutRecords(&kinesis.PutRecordsInput{
+		StreamName: aws.String(result.StreamName),
+		Records:    records,
+	})
+	if err != nil {
+		return result, fmt.Errorf("unable to write healthcheck record: %v", err)
+	}
+
+	if aws.Int64Value(resp.FailedRecordCount) > 0 {
+		if len(resp.Records) == 0 {
+			return result, fmt.Errorf("unable to write healthcheck record")
+		}
+		return result, fmt.Errorf("unable to write healthcheck record: %s: %s",
+			aws.StringValue(resp.Records[0].ErrorCode), aws.StringValue(resp.Records[0].ErrorMessage))
+	}
+
+	result.RecordSent = true
+	k.Log.Infof("Self test of stream %q in %s passed, stream status %s",
+		result.StreamName, result.Region, result.StreamStatus)
+	return result, nil
+}
@@ -0,0 +1,93 @@
+package kinesis
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest_DryRun(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+
+	k := KinesisOutput{
+		Log:          testutil.Logger{},
+		Region:       "us-east-1",
+		StreamName:   "stream",
+		serializer:   influx.NewSerializer(),
+		svc:          svc,
+		endpoint:     "https://kinesis.us-east-1.amazonaws.com",
+		streamStatus: map[string]string{"stream": kinesis.StreamStatusActive},
+	}
+
+	result, err := k.selfTest(true)
+	require.NoError(t, err)
+	require.Equal(t, &SelfTestResult{
+		Region:       "us-east-1",
+		Endpoint:     "https://kinesis.us-east-1.amazonaws.com",
+		StreamName:   "stream",
+		StreamStatus: kinesis.StreamStatusActive,
+	}, result)
+	require.Empty(t, svc.requests)
+}
+
+func TestSelfTest_SendsHealthCheckRecord(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(1, 0)
+
+	k := KinesisOutput{
+		Log:          testutil.Logger{},
+		Region:       "us-east-1",
+		StreamName:   "stream",
+		serializer:   influx.NewSerializer(),
+		svc:          svc,
+		streamStatus: map[string]string{"stream": kinesis.StreamStatusActive},
+	}
+
+	result, err := k.selfTest(false)
+	require.NoError(t, err)
+	require.True(t, result.RecordSent)
+
+	require.Len(t, svc.requests, 1)
+	require.Len(t, svc.requests[0].Records, 1)
+	require.Equal(t, healthCheckPartitionKey, *svc.requests[0].Records[0].PartitionKey)
+	require.Contains(t, string(svc.requests[0].Records[0].Data), "kinesis_healthcheck")
+}
+
+func TestSelfTest_RecordFailure(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(0, 1)
+
+	k := KinesisOutput{
+		Log:        testutil.Logger{},
+		Region:     "us-east-1",
+		StreamName: "stream",
+		serializer: influx.NewSerializer(),
+		svc:        svc,
+	}
+
+	result, err := k.selfTest(false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "InternalFailure")
+	require.False(t, result.RecordSent)
+}
+
+func TestSelfTest_ConnectFailureStreamNames(t *testing.T) {
+	describe := &mockKinesisDescribeStreamSummary{}
+	describe.SetupErrorResponse(awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream first not found", nil))
+
+	k := New(&mockKinesisPutRecords{KinesisAPI: describe}, influx.NewSerializer())
+	k.Log = testutil.Logger{}
+	k.Region = "us-east-1"
+	k.StreamNames = []string{"first", "second"}
+	k.Partition = &Partition{Method: "random"}
+	require.NoError(t, k.Init())
+
+	result, err := k.SelfTest(true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unable to connect to stream "first"`)
+	require.Equal(t, "first", result.StreamName)
+}
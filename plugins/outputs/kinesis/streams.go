@@ -0,0 +1,54 @@
+package kinesis
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// streamRecords holds the records to write to a stream.
+type streamRecords struct {
+	stream  string
+	records []*kinesis.PutRecordsRequestEntry
+}
+
+// streamNames returns the streams records are written to.
+func (k *KinesisOutput) streamNames() []string {
+	if len(k.StreamNames) > 0 {
+		return k.StreamNames
+	}
+	return []string{k.StreamName}
+}
+
+// assignStreams distributes the records across the streams, either in turn
+// or by the hash of the partition key, keeping the order of the records
+// within each stream.
+func (k *KinesisOutput) assignStreams(r []*kinesis.PutRecordsRequestEntry) []streamRecords {
+	streams := k.streamNames()
+	if len(streams) == 1 {
+		return []streamRecords{{stream: streams[0], records: r}}
+	}
+
+	assigned := make([][]*kinesis.PutRecordsRequestEntry, len(streams))
+	for _, record := range r {
+		var i uint32
+		if k.StreamStrategy == "hash" {
+			h := fnv.New32a()
+			h.Write([]byte(aws.StringValue(record.PartitionKey)))
+			i = h.Sum32() % uint32(len(streams))
+		} else {
+			i = (atomic.AddUint32(&k.nextStream, 1) - 1) % uint32(len(streams))
+		}
+		assigned[i] = append(assigned[i], record)
+	}
+
+	result := []streamRecords{}
+	for i, records := range assigned {
+		if len(records) > 0 {
+			result = append(result, streamRecords{stream: streams[i], records: records})
+		}
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+package kinesis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignStreams_RoundRobin(t *testing.T) {
+	k := KinesisOutput{
+		Log:         testutil.Logger{},
+		StreamNames: []string{"stream1", "stream2", "stream3"},
+	}
+	require.NoError(t, k.Init())
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "static"
+	}
+	counts := map[string]int{}
+	for _, streamRecords := range k.assignStreams(createWALRecords(keys...)) {
+		counts[streamRecords.stream] += len(streamRecords.records)
+	}
+	// the next write continues where the previous one stopped
+	for _, streamRecords := range k.assignStreams(createWALRecords(keys[:5]...)) {
+		counts[streamRecords.stream] += len(streamRecords.records)
+	}
+	require.Equal(t, map[string]int{"stream1": 5, "stream2": 5, "stream3": 5}, counts)
+}
+
+func TestAssignStreams_Hash(t *testing.T) {
+	k := KinesisOutput{
+		Log:            testutil.Logger{},
+		StreamNames:    []string{"stream1", "stream2", "stream3"},
+		StreamStrategy: "hash",
+	}
+	require.NoError(t, k.Init())
+
+	keys := []string{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i%20))
+	}
+
+	streams := map[string]string{}
+	for _, streamRecords := range k.assignStreams(createWALRecords(keys...)) {
+		for _, record := range streamRecords.records {
+			key := aws.StringValue(record.PartitionKey)
+			if stream, ok := streams[key]; ok {
+				require.Equal(t, stream, streamRecords.stream, "key %q written to several streams", key)
+			}
+			streams[key] = streamRecords.stream
+		}
+	}
+	require.Len(t, streams, 20)
+}
+
+func TestWrite_StreamNames(t *testing.T) {
+	svc := &mockKinesisPutRecords{}
+	svc.SetupGenericResponse(2, 0)
+	svc.SetupGenericResponse(2, 0)
+
+	k := KinesisOutput{
+		Log:         testutil.Logger{},
+		StreamNames: []string{"stream1", "stream2"},
+		svc:         svc,
+	}
+	require.NoError(t, k.Init())
+
+	result := k.writeRecords(createWALRecords("a", "b", "c", "d"))
+	require.Equal(t, 4, result.records)
+	require.Zero(t, result.failed)
+
+	require.Len(t, svc.requests, 2)
+	require.Equal(t, "stream1", aws.StringValue(svc.requests[0].StreamName))
+	require.Equal(t, "a", aws.StringValue(svc.requests[0].Records[0].PartitionKey))
+	require.Equal(t, "c", aws.StringValue(svc.requests[0].Records[1].PartitionKey))
+	require.Equal(t, "stream2", aws.StringValue(svc.requests[1].StreamName))
+	require.Equal(t, "b", aws.StringValue(svc.requests[1].Records[0].PartitionKey))
+	require.Equal(t, "d", aws.StringValue(svc.requests[1].Records[1].PartitionKey))
+}
+
+func TestValidateStream_StreamNames(t *testing.T) {
+	svc := &mockKinesisDescribeStreamSummary{}
+	svc.SetupResponse(kinesis.StreamStatusActive)
+
+	k := KinesisOutput{
+		Log:         testutil.Logger{},
+		StreamNames: []string{"stream1", "stream2"},
+		svc:         svc,
+	}
+	require.NoError(t, k.Init())
+	require.NoError(t, k.validateStream())
+
+	require.Len(t, svc.requests, 2)
+	require.Equal(t, "stream1", aws.StringValue(svc.requests[0].StreamName))
+	require.Equal(t, "stream2", aws.StringValue(svc.requests[1].StreamName))
+}
+
+func TestInit_InvalidStreamNames(t *testing.T) {
+	k := KinesisOutput{
+		Log:         testutil.Logger{},
+		StreamName:  "stream",
+		StreamNames: []string{"stream1", "stream2"},
+	}
+	require.Error(t, k.Init())
+
+	k = KinesisOutput{
+		Log:            testutil.Logger{},
+		StreamNames:    []string{"stream1", "stream2"},
+		StreamStrategy: "random",
+	}
+	require.Error(t, k.Init())
+}
@@ -0,0 +1,249 @@
+package kinesis
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// walHeaderSize is the size of the length and checksum preceding each entry.
+const walHeaderSize = 8
+
+var errWALFull = errors.New("write-ahead log is full")
+
+// writeAheadLog persists buffered records so they can be replayed after the
+// agent exits without sending them. Each entry is the payload length and its
+// CRC32 checksum followed by the partition key length, the partition key and
+// the record data.
+//
+// Positions are absolute offsets across the lifetime of the log, so that a
+// position taken before earlier records are discarded stays valid.
+type writeAheadLog struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+
+	file *os.File
+	base int64
+	size int64
+}
+
+// openWriteAheadLog opens or creates the log at path and returns the records
+// it contains. A truncated or corrupted tail is removed from the file, and
+// the number of bytes removed is returned.
+func openWriteAheadLog(path string, maxSize int64) (*writeAheadLog, []*kinesis.PutRecordsRequestEntry, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	records, valid, err := readWriteAheadLog(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+
+	corrupted := info.Size() - valid
+	if corrupted > 0 {
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, nil, 0, err
+		}
+	}
+
+	w := &writeAheadLog{
+		path:    path,
+		maxSize: maxSize,
+		file:    file,
+		size:    valid,
+	}
+	return w, records, corrupted, nil
+}
+
+// readWriteAheadLog reads entries until the end of the file or the first
+// invalid entry, returning the records and the length of the valid prefix.
+// An entry whose length runs past the end of the file is invalid, so that a
+// corrupted header does not allocate more than the file holds.
+func readWriteAheadLog(file *os.File) ([]*kinesis.PutRecordsRequestEntry, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	records := []*kinesis.PutRecordsRequestEntry{}
+	var valid int64
+
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return records, valid, nil
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(length) > info.Size()-valid-walHeaderSize {
+			return records, valid, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return records, valid, nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return records, valid, nil
+		}
+
+		record, ok := decodeWALEntry(payload)
+		if !ok {
+			return records, valid, nil
+		}
+
+		records = append(records, record)
+		valid += walHeaderSize + int64(length)
+	}
+}
+
+func encodeWALEntry(record *kinesis.PutRecordsRequestEntry) []byte {
+	key := aws.StringValue(record.PartitionKey)
+	payloadLength := 2 + len(key) + len(record.Data)
+
+	entry := make([]byte, walHeaderSize+payloadLength)
+	payload := entry[walHeaderSize:]
+	binary.BigEndian.PutUint16(payload[0:2], uint16(len(key)))
+	copy(payload[2:], key)
+	copy(payload[2+len(key):], record.Data)
+
+	binary.BigEndian.PutUint32(entry[0:4], uint32(payloadLength))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	return entry
+}
+
+func decodeWALEntry(payload []byte) (*kinesis.PutRecordsRequestEntry, bool) {
+	if len(payload) < 2 {
+		return nil, false
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(payload[0:2]))
+	if len(payload) < 2+keyLength {
+		return nil, false
+	}
+
+	return &kinesis.PutRecordsRequestEntry{
+		PartitionKey: aws.String(string(payload[2 : 2+keyLength])),
+		Data:         append([]byte{}, payload[2+keyLength:]...),
+	}, true
+}
+
+// append persists the records, failing with errWALFull if they would grow
+// the log beyond its maximum size.
+func (w *writeAheadLog) append(r []*kinesis.PutRecordsRequestEntry) error {
+	w.Lock()
+	defer w.Unlock()
+
+	var data []byte
+	for _, record := range r {
+		data = append(data, encodeWALEntry(record)...)
+	}
+
+	if w.maxSize > 0 && w.size+int64(len(data)) > w.maxSize {
+		return errWALFull
+	}
+
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	return nil
+}
+
+// position returns the absolute offset of the end of the log.
+func (w *writeAheadLog) position() int64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.base + w.size
+}
+
+// discard removes the entries before the absolute position. The remaining
+// entries are written to a new file that replaces the log, so a crash while
+// discarding keeps either the old or the new log.
+func (w *writeAheadLog) discard(position int64) error {
+	w.Lock()
+	defer w.Unlock()
+
+	n := position - w.base
+	if n <= 0 {
+		return nil
+	}
+	if n > w.size {
+		n = w.size
+	}
+
+	if _, err := w.file.Seek(n, io.SeekStart); err != nil {
+		return err
+	}
+	remaining, err := ioutil.ReadAll(w.file)
+	if err != nil {
+		return err
+	}
+
+	tmp := w.path + ".tmp"
+	if err := writeFileSync(tmp, remaining); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.base += n
+	w.size -= n
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (w *writeAheadLog) close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
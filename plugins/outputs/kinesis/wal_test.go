@@ -0,0 +1,156 @@
+package kinesis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/require"
+)
+
+func createWALRecords(keys ...string) []*kinesis.PutRecordsRequestEntry {
+	records := []*kinesis.PutRecordsRequestEntry{}
+	for _, key := range keys {
+		records = append(records, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(key),
+			Data:         []byte("data for " + key),
+		})
+	}
+	return records
+}
+
+func TestWriteAheadLog_Replay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a", "b", "c")
+
+	wal, replayed, corrupted, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Empty(t, replayed)
+	require.Zero(t, corrupted)
+
+	require.NoError(t, wal.append(records[:2]))
+	require.NoError(t, wal.append(records[2:]))
+	require.NoError(t, wal.close())
+
+	wal, replayed, corrupted, err = openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records, replayed)
+	require.Zero(t, corrupted)
+	require.NoError(t, wal.close())
+}
+
+func TestWriteAheadLog_CorruptedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a", "b")
+
+	wal, _, _, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(records))
+	require.NoError(t, wal.close())
+
+	// simulate a crash part way through writing the second entry
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	wal, replayed, corrupted, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records[:1], replayed)
+	require.Equal(t, int64(len(encodeWALEntry(records[1]))-3), corrupted)
+
+	// entries appended after recovery are readable
+	require.NoError(t, wal.append(records[1:]))
+	require.NoError(t, wal.close())
+
+	wal, replayed, corrupted, err = openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records, replayed)
+	require.Zero(t, corrupted)
+	require.NoError(t, wal.close())
+}
+
+func TestWriteAheadLog_ChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a", "b")
+
+	wal, _, _, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(records))
+	require.NoError(t, wal.close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	wal, replayed, corrupted, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records[:1], replayed)
+	require.Equal(t, int64(len(encodeWALEntry(records[1]))), corrupted)
+	require.NoError(t, wal.close())
+}
+
+func TestWriteAheadLog_Discard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a", "b", "c")
+
+	wal, _, _, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, wal.append(records[:1]))
+	first := wal.position()
+	require.NoError(t, wal.append(records[1:2]))
+	second := wal.position()
+	require.NoError(t, wal.append(records[2:]))
+
+	require.NoError(t, wal.discard(first))
+	// positions taken before a discard remain valid
+	require.NoError(t, wal.discard(second))
+	require.NoError(t, wal.discard(first))
+	require.NoError(t, wal.close())
+
+	wal, replayed, _, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records[2:], replayed)
+	require.NoError(t, wal.close())
+}
+
+func TestWriteAheadLog_MaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a", "b")
+	entrySize := int64(len(encodeWALEntry(records[0])))
+
+	wal, _, _, err := openWriteAheadLog(path, entrySize)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(records[:1]))
+	require.Equal(t, errWALFull, wal.append(records[1:]))
+	require.Equal(t, entrySize, wal.position())
+	require.NoError(t, wal.close())
+}
+
+func TestWriteAheadLog_GarbageLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kinesis.wal")
+	records := createWALRecords("a")
+
+	wal, _, _, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.NoError(t, wal.append(records))
+	require.NoError(t, wal.close())
+
+	// a header claiming close to 4GiB follows the valid entry
+	garbage := []byte{0xff, 0xff, 0xff, 0xf0, 0x12, 0x34, 0x56, 0x78, 'x'}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write(garbage)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	wal, replayed, corrupted, err := openWriteAheadLog(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, records, replayed)
+	require.Equal(t, int64(len(garbage)), corrupted)
+	require.NoError(t, wal.close())
+}
@@ -0,0 +1,256 @@
+// Package fakekinesis provides an in-process fake of the Kinesis Data Streams
+// API for integration testing plugins through the real AWS SDK client.
+//
+// Only PutRecords, DescribeStreamSummary and CreateStream are implemented.
+// Point a client at the fake by setting its endpoint to Server.URL.
+package fakekinesis
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const targetPrefix = "Kinesis_20131202."
+
+// Record is a record stored by the fake.
+type Record struct {
+	PartitionKey   string
+	Data           []byte
+	ShardID        string
+	SequenceNumber string
+}
+
+type stream struct {
+	status     string
+	shardCount int
+	created    time.Time
+	records    []Record
+}
+
+type apiError struct {
+	code       string
+	statusCode int
+}
+
+// Server is a fake Kinesis endpoint.
+type Server struct {
+	*httptest.Server
+
+	sync.Mutex
+	streams    map[string]*stream
+	operations []string
+	failures   map[string][]apiError
+	sequence   int64
+}
+
+// NewServer starts a fake Kinesis endpoint. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		streams:  make(map[string]*stream),
+		failures: make(map[string][]apiError),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// AddStream creates an active stream with the given number of shards.
+func (s *Server) AddStream(name string, shardCount int) {
+	s.Lock()
+	defer s.Unlock()
+	s.addStream(name, shardCount)
+}
+
+// FailNext makes the next call to the operation, such as "PutRecords", fail
+// with the given error code and HTTP status. Failures queue in order.
+func (s *Server) FailNext(operation string, code string, statusCode int) {
+	s.Lock()
+	defer s.Unlock()
+	s.failures[operation] = append(s.failures[operation], apiError{code: code, statusCode: statusCode})
+}
+
+// Records returns the records successfully written to the stream.
+func (s *Server) Records(name string) []Record {
+	s.Lock()
+	defer s.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		return nil
+	}
+	return append([]Record(nil), st.records...)
+}
+
+// Operations returns the names of all received operations in order,
+// including failed ones.
+func (s *Server) Operations() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.operations...)
+}
+
+func (s *Server) addStream(name string, shardCount int) {
+	s.streams[name] = &stream{
+		status:     "ACTIVE",
+		shardCount: shardCount,
+		created:    time.Now(),
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, targetPrefix) {
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("unknown target %q", target))
+		return
+	}
+	operation := strings.TrimPrefix(target, targetPrefix)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.operations = append(s.operations, operation)
+	if failures := s.failures[operation]; len(failures) > 0 {
+		s.failures[operation] = failures[1:]
+		writeError(w, failures[0].statusCode, failures[0].code, "injected failure")
+		return
+	}
+
+	switch operation {
+	case "PutRecords":
+		s.putRecords(w, r)
+	case "DescribeStreamSummary":
+		s.describeStreamSummary(w, r)
+	case "CreateStream":
+		s.createStream(w, r)
+	default:
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("operation %q not supported", operation))
+	}
+}
+
+func (s *Server) putRecords(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		StreamName string
+		Records    []struct {
+			Data         []byte
+			PartitionKey string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+
+	st, ok := s.streams[input.StreamName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ResourceNotFoundException", fmt.Sprintf("Stream %s not found", input.StreamName))
+		return
+	}
+
+	type resultEntry struct {
+		SequenceNumber string `json:"SequenceNumber"`
+		ShardID        string `json:"ShardId"`
+	}
+	results := make([]resultEntry, 0, len(input.Records))
+	for _, entry := range input.Records {
+		s.sequence++
+		record := Record{
+			PartitionKey:   entry.PartitionKey,
+			Data:           entry.Data,
+			ShardID:        shardID(entry.PartitionKey, st.shardCount),
+			SequenceNumber: fmt.Sprintf("%056d", s.sequence),
+		}
+		st.records = append(st.records, record)
+		results = append(results, resultEntry{
+			SequenceNumber: record.SequenceNumber,
+			ShardID:        record.ShardID,
+		})
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"FailedRecordCount": 0,
+		"Records":           results,
+		"EncryptionType":    "NONE",
+	})
+}
+
+func (s *Server) describeStreamSummary(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		StreamName string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+
+	st, ok := s.streams[input.StreamName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "ResourceNotFoundException", fmt.Sprintf("Stream %s not found", input.StreamName))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"StreamDescriptionSummary": map[string]interface{}{
+			"StreamName":              input.StreamName,
+			"StreamARN":               "arn:aws:kinesis:us-east-1:000000000000:stream/" + input.StreamName,
+			"StreamStatus":            st.status,
+			"OpenShardCount":          st.shardCount,
+			"ConsumerCount":           0,
+			"EncryptionType":          "NONE",
+			"RetentionPeriodHours":    24,
+			"StreamCreationTimestamp": float64(st.created.Unix()),
+			"EnhancedMonitoring":      []interface{}{},
+		},
+	})
+}
+
+func (s *Server) createStream(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		StreamName string
+		ShardCount int
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+
+	if _, ok := s.streams[input.StreamName]; ok {
+		writeError(w, http.StatusBadRequest, "ResourceInUseException", fmt.Sprintf("Stream %s already exists", input.StreamName))
+		return
+	}
+
+	shardCount := input.ShardCount
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	s.addStream(input.StreamName, shardCount)
+	writeJSON(w, map[string]interface{}{})
+}
+
+// shardID deterministically maps a partition key to a shard using the MD5
+// hash of the key, as Kinesis does.
+func shardID(partitionKey string, shardCount int) string {
+	sum := md5.Sum([]byte(partitionKey))
+	shard := binary.BigEndian.Uint64(sum[:8]) % uint64(shardCount)
+	return fmt.Sprintf("shardId-%012d", shard)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"__type":  code,
+		"message": message,
+	})
+}